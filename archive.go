@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type Archive struct{}
+
+type ArchiveList struct {
+	Archive string `long:"archive" short:"a" env:"ARCHIVE_FILE" default:"-" description:"Archive to read, - for STDIN"`
+	Format  string `long:"format" env:"ARCHIVE_FORMAT" default:"table" description:"Output format: table, json"`
+}
+
+type ArchiveVerify struct {
+	Archive string `long:"archive" short:"a" env:"ARCHIVE_FILE" default:"-" description:"Archive to read, - for STDIN"`
+}
+
+type ArchiveDiff struct {
+	Archive string `long:"archive" short:"a" env:"ARCHIVE_FILE" default:"-" description:"Archive to read, - for STDIN"`
+	Against string `long:"against" env:"ARCHIVE_AGAINST" description:"Archive to compare with, instead of the cluster"`
+	Format  string `long:"format" env:"ARCHIVE_FORMAT" default:"table" description:"Output format: table, json"`
+}
+
+var (
+	archive       Archive
+	archiveList   ArchiveList
+	archiveVerify ArchiveVerify
+	archiveDiff   ArchiveDiff
+)
+
+func checkFormat(format string) error {
+	switch format {
+	case "table", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, expected table or json", format)
+}
+
+func writeJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+	return nil
+}
+
+func (o *ArchiveList) Execute(args []string) error {
+	if err := checkFormat(o.Format); err != nil {
+		return err
+	}
+	in, err := openArchive(o.Archive)
+	if err != nil {
+		return fmt.Errorf("could not read archive: %v", err)
+	}
+	defer in.Close()
+
+	entries, _, err := backup.List(context.Background(), in)
+	if err != nil {
+		return fmt.Errorf("could not read archive: %v", err)
+	}
+	if o.Format == "json" {
+		return writeJSON(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tMODIFIED INDEX\tEXPIRATION")
+	for _, entry := range entries {
+		key := entry.Key
+		if entry.Dir {
+			key += "/"
+		}
+		expiration := ""
+		if entry.Expiration != nil {
+			expiration = entry.Expiration.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", key, entry.Size, entry.ModifiedIndex, expiration)
+	}
+	return w.Flush()
+}
+
+func (o *ArchiveVerify) Execute(args []string) error {
+	in, err := openArchive(o.Archive)
+	if err != nil {
+		return fmt.Errorf("could not read archive: %v", err)
+	}
+	defer in.Close()
+
+	m, err := backup.Verify(context.Background(), in)
+	if err != nil {
+		return fmt.Errorf("archive is damaged: %v", err)
+	}
+	if m.Digest == "" {
+		fmt.Println("ok (written by an older version, without a key count or digest to check)")
+		return nil
+	}
+	fmt.Printf("ok: %d keys at etcd index %d, taken %s\n", m.Keys, m.EtcdIndex, m.Time.Format(time.RFC3339))
+	fmt.Printf("digest %s\n", m.Digest)
+	if c := m.Cluster; c != nil {
+		if c.LeaderID != "" {
+			fmt.Printf("from etcd %s, %d members, leader %s at raft term %d\n", c.Version, len(c.Members), c.LeaderID, c.RaftTerm)
+		} else {
+			fmt.Printf("from etcd %s, %d members\n", c.Version, len(c.Members))
+		}
+		for _, member := range c.Members {
+			fmt.Printf("  %s %s peers %s clients %s\n", member.ID, member.Name,
+				strings.Join(member.PeerURLs, ","), strings.Join(member.ClientURLs, ","))
+		}
+	}
+	return nil
+}
+
+func (o *ArchiveDiff) Execute(args []string) error {
+	if err := checkFormat(o.Format); err != nil {
+		return err
+	}
+	in, err := openArchive(o.Archive)
+	if err != nil {
+		return fmt.Errorf("could not read archive: %v", err)
+	}
+	defer in.Close()
+
+	var changes []backup.Change
+	if o.Against == "" {
+		changes, err = backup.DiffCluster(context.Background(), cluster(), in)
+	} else {
+		against, openErr := openArchive(o.Against)
+		if openErr != nil {
+			return fmt.Errorf("could not read archive: %v", openErr)
+		}
+		defer against.Close()
+		changes, err = backup.Diff(context.Background(), in, against)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.Format == "json" {
+		return writeJSON(changes)
+	}
+	for _, change := range changes {
+		key := change.Key
+		if change.Dir {
+			key += "/"
+		}
+		fmt.Printf("%-10s %s\n", change.Kind, key)
+	}
+	fmt.Printf("%d changes\n", len(changes))
+	return nil
+}
+
+func init() {
+	cmd, _ := parser.AddCommand("archive",
+		"Inspect archives",
+		"Commands about archives written by etcdbk, local or piped from STDIN.",
+		&archive,
+	)
+	cmd.AddCommand("list",
+		"List the keys of an archive",
+		"List the keys of an archive, with their size, etcd index and expiration.",
+		&archiveList,
+	)
+	cmd.AddCommand("verify",
+		"Check an archive",
+		"Read a whole archive, checking its compression and paths, and that it holds the keys its manifest counted and digested.",
+		&archiveVerify,
+	)
+	cmd.AddCommand("diff",
+		"Compare an archive",
+		"Print the keys added, removed or changed since the archive was taken, in the cluster or in the --against archive. Indexes are not compared.",
+		&archiveDiff,
+	)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/goamz/goamz/aws"
+	"github.com/vaughan0/go-ini"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Temporary credentials are replaced once they are this close to expiring,
+// so that an upload never starts with credentials about to lapse.
+const credentialRefreshMargin = 5 * time.Minute
+
+// goamz treats a session token without an expiration as already expired and
+// silently swaps in credentials from its own lookup. Long-lived tokens are
+// given this expiration instead.
+var noExpiration = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// credentialChain resolves AWS credentials from, in order, explicit options,
+// the environment, a shared credentials file profile and the EC2 instance
+// role. Resolved credentials are cached until shortly before they expire.
+type credentialChain struct {
+	AccessKey, SecretKey, SessionToken string
+	Profile                            string
+
+	mu     sync.Mutex
+	cached *aws.Auth
+}
+
+func (c *credentialChain) Auth() (aws.Auth, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached != nil {
+		expiration := c.cached.Expiration()
+		if time.Until(expiration) > credentialRefreshMargin {
+			return *c.cached, nil
+		}
+		log.WithField("expiration", expiration).Info("refreshing temporary AWS credentials")
+	}
+
+	auth, source, err := c.resolve()
+	if err != nil {
+		return aws.Auth{}, err
+	}
+	log.WithFields(log.Fields{
+		"source":     source,
+		"expiration": auth.Expiration(),
+	}).Debug("resolved AWS credentials")
+
+	c.cached = &auth
+	return auth, nil
+}
+
+func (c *credentialChain) resolve() (aws.Auth, string, error) {
+	if c.AccessKey != "" && c.SecretKey != "" {
+		return staticAuth(c.AccessKey, c.SecretKey, c.SessionToken), "options", nil
+	}
+
+	auth, err := envAuth()
+	if err == nil {
+		return auth, "environment", nil
+	}
+	log.WithField("error", err).Debug("no usable environment credentials")
+
+	auth, err = sharedAuth(c.Profile)
+	if err == nil {
+		return auth, "shared credentials file", nil
+	}
+	log.WithField("error", err).Debug("no usable shared credentials")
+
+	auth, err = instanceAuth()
+	if err == nil {
+		return auth, "instance role", nil
+	}
+	log.WithField("error", err).Debug("no usable instance role credentials")
+
+	return aws.Auth{}, "", errors.New("no AWS credentials found in options, environment, shared credentials file or instance metadata")
+}
+
+func staticAuth(accessKey, secretKey, token string) aws.Auth {
+	return *aws.NewAuth(accessKey, secretKey, token, noExpiration)
+}
+
+// envAuth reads the credential variables that are not already bound to
+// options. It stands in for aws.EnvAuth, which loses session tokens to the
+// goamz expiry check.
+func envAuth() (aws.Auth, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY"), os.Getenv("AWS_SECRET_KEY")
+	if accessKey == "" || secretKey == "" {
+		return aws.Auth{}, errors.New("AWS_ACCESS_KEY and AWS_SECRET_KEY are not set")
+	}
+	return staticAuth(accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN")), nil
+}
+
+// sharedAuth reads a profile from the shared credentials file. Unlike
+// aws.SharedAuth it takes the profile name explicitly and honours session
+// tokens.
+func sharedAuth(profile string) (aws.Auth, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		path = os.Getenv("AWS_CREDENTIAL_FILE")
+	}
+	if path == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return aws.Auth{}, errors.New("could not locate the shared credentials file, HOME is not set")
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	file, err := ini.LoadFile(path)
+	if err != nil {
+		return aws.Auth{}, err
+	}
+
+	section, ok := file[profile]
+	if !ok {
+		return aws.Auth{}, fmt.Errorf("profile %q not found in %s", profile, path)
+	}
+	if section["aws_access_key_id"] == "" || section["aws_secret_access_key"] == "" {
+		return aws.Auth{}, fmt.Errorf("profile %q in %s is missing a key", profile, path)
+	}
+
+	return staticAuth(section["aws_access_key_id"], section["aws_secret_access_key"], section["aws_session_token"]), nil
+}
+
+// instanceAuth fetches the temporary credentials of the EC2 instance role.
+func instanceAuth() (aws.Auth, error) {
+	const credentialPath = "iam/security-credentials/"
+
+	role, err := aws.GetMetaData(credentialPath)
+	if err != nil {
+		return aws.Auth{}, err
+	}
+
+	body, err := aws.GetMetaData(credentialPath + strings.TrimSpace(string(role)))
+	if err != nil {
+		return aws.Auth{}, err
+	}
+
+	var cred struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &cred); err != nil {
+		return aws.Auth{}, err
+	}
+
+	return *aws.NewAuth(cred.AccessKeyId, cred.SecretAccessKey, cred.Token, cred.Expiration), nil
+}
@@ -0,0 +1,268 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteArchive streams a tar.gz archive of rootNode into w, with values
+// redacted by r, and returns its manifest: m, completed with what the
+// archive holds. It only returns nil once both the tar and the gzip stream
+// have been closed cleanly.
+//
+// The entries of keys are reproducible: they are sorted by key, and carry
+// the snapshot time of the manifest instead of the current time. The
+// manifest also records the cluster's leader and raft term, which move with
+// elections, so two archives hold the same keys when their digests match,
+// whether or not their bytes do.
+func WriteArchive(w io.Writer, rootNode *etcd.Node, m Manifest, r *Redactor) (Manifest, error) {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	m.Redacted = r != nil
+	m.Time = m.Time.UTC().Truncate(time.Second)
+	m.Keys = CountKeys(rootNode)
+	m.Digest = contentHash(rootNode, nil, r)
+	if err := tarWriter.WriteHeader(m.header()); err != nil {
+		gzipWriter.Close()
+		return m, err
+	}
+	if err := writeNode(tarWriter, rootNode, m.Time, r); err != nil {
+		gzipWriter.Close()
+		return m, err
+	}
+
+	// Close the tar writer, then the gzip writer, which flush what's left.
+	if err := tarWriter.Close(); err != nil {
+		gzipWriter.Close()
+		return m, err
+	}
+	return m, gzipWriter.Close()
+}
+
+func writeNode(w *tar.Writer, node *etcd.Node, modTime time.Time, r *Redactor) error { // I'm recursive!
+	log.WithField("key", node.Key).Debug("writing to tarball")
+	if node.Dir {
+		// Always write a header for a directory, unless it's the root.
+		if len(node.Key) > 0 {
+			err := w.WriteHeader(&tar.Header{
+				Name:       keyPath(node.Key) + "/",
+				Typeflag:   tar.TypeDir,
+				Mode:       0755,
+				Uname:      "root",
+				Gname:      "root",
+				ModTime:    modTime,
+				PAXRecords: nodeRecords(node),
+				Format:     tar.FormatPAX,
+			})
+			if err != nil {
+				return fmt.Errorf("could not archive %s: %v", node.Key, err)
+			}
+		}
+
+		for _, subNode := range sortedNodes(node.Nodes) {
+			if err := writeNode(w, subNode, modTime, r); err != nil { // see?
+				return err
+			}
+		}
+		return nil
+	}
+
+	buf := bytes.NewBuffer([]byte(r.redact(node.Key, node.Value)))
+	err := w.WriteHeader(&tar.Header{
+		Name:       keyPath(node.Key),
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		Size:       int64(buf.Len()),
+		Uname:      "root",
+		Gname:      "root",
+		ModTime:    modTime,
+		PAXRecords: nodeRecords(node),
+		Format:     tar.FormatPAX,
+	})
+	if err == nil {
+		_, err = buf.WriteTo(w)
+	}
+	if err != nil {
+		return fmt.Errorf("could not archive %s: %v", node.Key, err)
+	}
+	return nil
+}
+
+// sortedNodes returns a copy of nodes, sorted by key.
+func sortedNodes(nodes etcd.Nodes) etcd.Nodes {
+	sorted := append(etcd.Nodes(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
+
+// CountKeys returns the number of values below node, not counting
+// directories.
+func CountKeys(node *etcd.Node) int {
+	if !node.Dir {
+		return 1
+	}
+
+	count := 0
+	for _, subNode := range node.Nodes {
+		count += CountKeys(subNode)
+	}
+	return count
+}
+
+// PAX records holding the metadata of a node.
+const (
+	recordModifiedIndex = "ETCDBK.modifiedIndex"
+	recordCreatedIndex  = "ETCDBK.createdIndex"
+	recordExpiration    = "ETCDBK.expiration"
+	// The key itself, when its path had to be escaped.
+	recordKey = "ETCDBK.key"
+)
+
+func nodeRecords(node *etcd.Node) map[string]string {
+	records := map[string]string{
+		recordModifiedIndex: strconv.FormatUint(node.ModifiedIndex, 10),
+		recordCreatedIndex:  strconv.FormatUint(node.CreatedIndex, 10),
+	}
+	if node.Expiration != nil {
+		records[recordExpiration] = node.Expiration.UTC().Format(time.RFC3339)
+	}
+	if keyPath(node.Key) != strings.TrimPrefix(node.Key, "/") {
+		records[recordKey] = node.Key
+	}
+	return records
+}
+
+// ReadArchive rebuilds the node tree of an archive written by WriteArchive,
+// along with its manifest.
+func ReadArchive(r io.Reader) (*etcd.Node, Manifest, error) {
+	var m Manifest
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, m, err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	root := &etcd.Node{Dir: true}
+	dirs := map[string]*etcd.Node{"/": root}
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			// Read up to the end of the gzip stream, which checks its
+			// checksum.
+			if _, err := io.Copy(ioutil.Discard, gzipReader); err != nil {
+				return nil, m, err
+			}
+			break
+		}
+		if err != nil {
+			return nil, m, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			m = readManifest(hdr)
+		case tar.TypeDir:
+			key, err := entryKey(hdr)
+			if err != nil {
+				return nil, m, err
+			}
+			node := dirNode(dirs, key)
+			readNodeRecords(node, hdr)
+		case tar.TypeReg:
+			key, err := entryKey(hdr)
+			if err != nil {
+				return nil, m, err
+			}
+			value, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				return nil, m, err
+			}
+			node := &etcd.Node{Key: key, Value: string(value)}
+			readNodeRecords(node, hdr)
+
+			parent := dirNode(dirs, path.Dir(node.Key))
+			parent.Nodes = append(parent.Nodes, node)
+		default:
+			log.WithField("name", hdr.Name).Debug("skipping unknown tarball entry")
+		}
+	}
+
+	return root, m, nil
+}
+
+// entryKey returns the key of an archive entry, refusing entries that
+// would escape the extraction directory, or whose key record doesn't match
+// their path.
+func entryKey(hdr *tar.Header) (string, error) {
+	p := strings.TrimSuffix(hdr.Name, "/")
+	if err := checkEntryPath(p); err != nil {
+		return "", err
+	}
+
+	if key, ok := hdr.PAXRecords[recordKey]; ok {
+		if !strings.HasPrefix(key, "/") || keyPath(key) != p {
+			return "", fmt.Errorf("archive path %q doesn't match its key %q", p, key)
+		}
+		return key, nil
+	}
+	if key, err := pathKey(p); err == nil {
+		return key, nil
+	}
+	// Older versions wrote keys unescaped.
+	return "/" + p, nil
+}
+
+// Walk calls fn for node and everything below it, parents first.
+func Walk(node *etcd.Node, fn func(*etcd.Node)) {
+	fn(node)
+	for _, subNode := range node.Nodes {
+		Walk(subNode, fn)
+	}
+}
+
+// dirNode returns the directory node for key, creating it and any missing
+// parents.
+func dirNode(dirs map[string]*etcd.Node, key string) *etcd.Node {
+	if node, ok := dirs[key]; ok {
+		return node
+	}
+
+	parent := dirNode(dirs, path.Dir(key))
+	node := &etcd.Node{Key: key, Dir: true}
+	parent.Nodes = append(parent.Nodes, node)
+	dirs[key] = node
+	return node
+}
+
+// readNodeRecords restores the metadata written by nodeRecords, or by older
+// versions as xattrs.
+func readNodeRecords(node *etcd.Node, hdr *tar.Header) {
+	records := map[string]string{
+		recordModifiedIndex: hdr.Xattrs["ModifiedIndex"],
+		recordCreatedIndex:  hdr.Xattrs["CreatedIndex"],
+		recordExpiration:    hdr.Xattrs["Expiration"],
+	}
+	for name, value := range hdr.PAXRecords {
+		records[name] = value
+	}
+
+	node.ModifiedIndex, _ = strconv.ParseUint(records[recordModifiedIndex], 10, 64)
+	node.CreatedIndex, _ = strconv.ParseUint(records[recordCreatedIndex], 10, 64)
+	if expiration, err := time.Parse(time.RFC3339, records[recordExpiration]); err == nil {
+		node.Expiration = &expiration
+	}
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestWriteArchiveReproducible(t *testing.T) {
+	srv := newTestServer(t)
+	client := Cluster{Machines: srv.Machines()}.Client()
+	defer client.Close()
+	response, err := Fetch(context.Background(), client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Date(2016, 2, 11, 18, 4, 5, 0, time.UTC)
+
+	// write archives the tree as described by the leader and term, with
+	// the members, time and index left alone.
+	write := func(leader string, term uint64) []byte {
+		t.Helper()
+		m, err := NewManifest(context.Background(), client, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Time = taken
+		m.Cluster.LeaderID, m.Cluster.RaftTerm = leader, term
+		var archive bytes.Buffer
+		if _, err := WriteArchive(&archive, response.Node, m, nil); err != nil {
+			t.Fatal(err)
+		}
+		return archive.Bytes()
+	}
+
+	before := write("8e9e05c52164694d", 4)
+	if again := write("8e9e05c52164694d", 4); !bytes.Equal(before, again) {
+		t.Error("archives of the same keys and cluster differ")
+	}
+
+	// An election later, nothing else changed: only the manifest differs.
+	after := write("91bc3c398fb3c146", 5)
+	beforeEntries, beforeManifest, err := List(context.Background(), bytes.NewReader(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterEntries, afterManifest, err := List(context.Background(), bytes.NewReader(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(beforeEntries, afterEntries) || beforeManifest.Digest != afterManifest.Digest {
+		t.Error("entries or digest of the same keys differ after an election")
+	}
+	if c := afterManifest.Cluster; c == nil || c.Version != srv.Version || len(c.Members) != 1 || c.LeaderID != "91bc3c398fb3c146" || c.RaftTerm != 5 {
+		t.Errorf("cluster = %+v, want its version, members, leader and term", c)
+	}
+}
+
+// failingWriter fails every write past its first n bytes.
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, errors.New("disk full")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteArchiveError(t *testing.T) {
+	// Values that don't compress, for the writes to reach the writer.
+	random := rand.New(rand.NewSource(1))
+	root := &etcd.Node{Dir: true}
+	for i := 0; i < 20; i++ {
+		value := make([]byte, 64<<10)
+		random.Read(value)
+		root.Nodes = append(root.Nodes, &etcd.Node{Key: fmt.Sprintf("/key-%02d", i), Value: string(value)})
+	}
+
+	_, err := WriteArchive(&failingWriter{n: 256 << 10}, root, Manifest{Time: time.Now()}, nil)
+	if err == nil || !strings.Contains(err.Error(), "could not archive /key-") || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("err = %v, want the key that couldn't be archived", err)
+	}
+}
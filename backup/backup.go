@@ -0,0 +1,149 @@
+// Package backup takes snapshots of etcd v2 clusters as tar.gz archives, and
+// restores them, without the etcdbk command line around it.
+//
+// Archives hold a directory per etcd directory and a file per value, named
+// after the key, with the etcd indexes and expiration of every node in PAX
+// records. A manifest ahead of the keys records when and at which etcd index
+// the snapshot was taken, how many values it holds and a digest of them, and
+// describes the cluster: its members, version and raft leader.
+//
+// Functions taking a context check it between requests to etcd, and cancel
+// the reads in flight when it is done.
+package backup
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Cluster is an etcd v2 cluster.
+type Cluster struct {
+	// Machines are the client URLs of the cluster, e.g.
+	// http://127.0.0.1:4001.
+	Machines []string
+	// FetchWorkers, when positive, fetches the tree one directory at a time
+	// with this many concurrent requests, instead of in a single request.
+	FetchWorkers int
+}
+
+// Client returns a client of the cluster, to be closed by the caller.
+func (c Cluster) Client() *etcd.Client {
+	return etcd.NewClient(c.Machines)
+}
+
+type SnapshotConfig struct {
+	Cluster Cluster
+	// Redaction replaces the values of matching keys in the archive. The
+	// zero Redaction archives every value as is.
+	Redaction Redaction
+}
+
+// Snapshot writes an archive of the whole cluster to w, and returns its
+// manifest.
+func Snapshot(ctx context.Context, cfg SnapshotConfig, w io.Writer) (Manifest, error) {
+	r, err := NewRedactor(cfg.Redaction)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	client := cfg.Cluster.Client()
+	defer client.Close()
+	response, err := Fetch(ctx, client, cfg.Cluster.FetchWorkers)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	m, err := NewManifest(ctx, client, response)
+	if err != nil {
+		log.WithField("error", err).Warn("archiving without a complete description of the cluster")
+	}
+	return WriteArchive(w, response.Node, m, r)
+}
+
+// NewManifest returns the manifest of a snapshot of response, fetched from
+// the cluster of client, for WriteArchive. Like Describe, it returns what
+// could be described of the cluster along with an error for the rest: the
+// manifest is usable either way.
+func NewManifest(ctx context.Context, client *etcd.Client, response *etcd.Response) (Manifest, error) {
+	info, err := Describe(ctx, client)
+	if info.RaftTerm == 0 {
+		info.RaftTerm = response.RaftTerm
+	}
+	return Manifest{Time: time.Now(), EtcdIndex: response.EtcdIndex, Cluster: info}, err
+}
+
+// get is client.Get, canceled when ctx is done.
+func get(ctx context.Context, client *etcd.Client, key string, sorted, recursive bool) (*etcd.Response, error) {
+	query := url.Values{}
+	if sorted {
+		query.Set("sorted", "true")
+	}
+	if recursive {
+		query.Set("recursive", "true")
+	}
+	p := keyURLPath(key)
+	if len(query) > 0 {
+		p += "?" + query.Encode()
+	}
+	raw, err := send(ctx, client, p)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Unmarshal()
+}
+
+// send GETs relativePath, below /v2/ of the machines of client, canceled
+// when ctx is done.
+func send(ctx context.Context, client *etcd.Client, relativePath string) (*etcd.RawResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cancel := make(chan bool)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(cancel)
+		case <-done:
+		}
+	}()
+
+	raw, err := client.SendRequest(etcd.NewRawRequest("GET", relativePath, nil, cancel))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return raw, nil
+}
+
+// keyURLPath escapes key like the go-etcd client does.
+func keyURLPath(key string) string {
+	p := strings.Replace(url.QueryEscape(path.Join("keys", key)), "%2F", "/", -1)
+	if p == "keys" {
+		p = "keys/"
+	}
+	return p
+}
+
+// etcd v2 API error codes.
+const (
+	EtcdErrKeyNotFound       = 100
+	EtcdErrNodeExist         = 105
+	EtcdErrEventIndexCleared = 401
+)
+
+// IsEtcdError tells whether err is an etcd API error with code.
+func IsEtcdError(err error, code int) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == code
+}
@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+)
+
+// newTestServer starts an etcdtest server holding a few applications, until
+// the test ends.
+func newTestServer(t *testing.T) *etcdtest.Server {
+	t.Helper()
+	srv := etcdtest.NewServer()
+	t.Cleanup(srv.Close)
+	for key, value := range map[string]string{
+		"/apps/web/config":   `{"port": 8080}`,
+		"/apps/web/password": "hunter2",
+		"/apps/db/config":    `{"port": 5432}`,
+		"/top":               "level",
+	} {
+		if err := srv.Set(key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return srv
+}
+
+// snapshot returns an archive of srv.
+func snapshot(t *testing.T, srv *etcdtest.Server, redaction Redaction) ([]byte, Manifest) {
+	t.Helper()
+	var archive bytes.Buffer
+	m, err := Snapshot(context.Background(), SnapshotConfig{
+		Cluster:   Cluster{Machines: srv.Machines()},
+		Redaction: redaction,
+	}, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes(), m
+}
+
+func TestSnapshot(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Set("/sessions/abc", "user-1", time.Hour)
+
+	archive, m := snapshot(t, srv, Redaction{})
+	if m.EtcdIndex != srv.Index() || m.Keys != 5 || m.Digest == "" || m.Redacted {
+		t.Errorf("manifest = %+v, want the index %d and 5 keys", m, srv.Index())
+	}
+	if c := m.Cluster; c == nil || c.Version != srv.Version || len(c.Members) != 1 || c.LeaderID == "" || c.RaftTerm != 1 {
+		t.Errorf("cluster = %+v, want the version, member, leader and term of the server", c)
+	}
+
+	verified, err := Verify(context.Background(), bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.EtcdIndex != m.EtcdIndex || verified.Keys != m.Keys || verified.Digest != m.Digest || !verified.Time.Equal(m.Time.Truncate(time.Second)) {
+		t.Errorf("read manifest %+v, want %+v", verified, m)
+	}
+
+	entries, _, err := List(context.Background(), bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+		if e.Key == "/sessions/abc" && e.Expiration == nil {
+			t.Error("expiration of /sessions/abc not archived")
+		}
+	}
+	want := []string{"/apps", "/apps/db", "/apps/db/config", "/apps/web", "/apps/web/config", "/apps/web/password", "/sessions", "/sessions/abc", "/top"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("listed %q, want %q", keys, want)
+	}
+}
+
+func TestSnapshotRedacted(t *testing.T) {
+	srv := newTestServer(t)
+	archive, m := snapshot(t, srv, Redaction{Builtin: true})
+	if !m.Redacted {
+		t.Error("manifest not marked redacted")
+	}
+
+	entries, _, err := List(context.Background(), bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Key == "/apps/web/password" && e.Size != len(DefaultRedactMarker) {
+			t.Errorf("password archived with %d bytes, want the marker", e.Size)
+		}
+	}
+	if _, err := Verify(context.Background(), bytes.NewReader(archive)); err != nil {
+		t.Errorf("redacted archive doesn't verify: %v", err)
+	}
+}
+
+// rewrite returns archive with its tar stream passed through edit.
+func rewrite(t *testing.T, archive []byte, edit func([]byte) []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	w := gzip.NewWriter(&out)
+	w.Write(edit(tarball))
+	w.Close()
+	return out.Bytes()
+}
+
+func TestVerifyDamaged(t *testing.T) {
+	archive, _ := snapshot(t, newTestServer(t), Redaction{})
+
+	tests := []struct {
+		name    string
+		archive []byte
+		err     string
+	}{
+		{
+			name:    "truncated",
+			archive: archive[:len(archive)/2],
+			err:     "EOF",
+		},
+		{
+			name: "value changed",
+			archive: rewrite(t, archive, func(tarball []byte) []byte {
+				return bytes.Replace(tarball, []byte("hunter2"), []byte("hunter3"), 1)
+			}),
+			err: "digest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Verify(context.Background(), bytes.NewReader(tt.archive))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClusterInfo describes the cluster a snapshot was taken from.
+type ClusterInfo struct {
+	// Version is the etcd server version of the machine that answered.
+	Version string        `json:"version,omitempty"`
+	Members []etcd.Member `json:"members,omitempty"`
+	// LeaderID is the member ID of the raft leader, RaftTerm its term.
+	LeaderID string `json:"leaderId,omitempty"`
+	RaftTerm uint64 `json:"raftTerm,omitempty"`
+}
+
+// Describe asks the cluster for its members, version and leader. Every
+// endpoint is tried: on errors, the returned ClusterInfo holds what could be
+// read, and the error what couldn't. RaftTerm is only set if one of the
+// endpoints reports it; key reads always do.
+func Describe(ctx context.Context, client *etcd.Client) (*ClusterInfo, error) {
+	info := &ClusterInfo{}
+	var failed []string
+	fail := func(endpoint string, err error) {
+		failed = append(failed, fmt.Sprintf("%s: %v", endpoint, err))
+	}
+
+	var members struct {
+		Members []etcd.Member `json:"members"`
+	}
+	if err := describeJSON(ctx, client, "members", info, &members); err != nil {
+		fail("members", err)
+	}
+	info.Members = members.Members
+
+	// /version lives outside of /v2/, where SendRequest sends everything;
+	// etcd redirects the dot segment to it. etcd 2.1 and later answer JSON,
+	// earlier versions "etcd 2.0.x".
+	if body, err := describeGet(ctx, client, "../version", info); err != nil {
+		fail("version", err)
+	} else {
+		var versions struct {
+			Server string `json:"etcdserver"`
+		}
+		if json.Unmarshal(body, &versions) == nil {
+			info.Version = versions.Server
+		} else {
+			info.Version = strings.TrimPrefix(strings.TrimSpace(string(body)), "etcd ")
+		}
+	}
+
+	var self struct {
+		LeaderInfo struct {
+			Leader string `json:"leader"`
+		} `json:"leaderInfo"`
+	}
+	if err := describeJSON(ctx, client, "stats/self", info, &self); err != nil {
+		fail("stats/self", err)
+	}
+	info.LeaderID = self.LeaderInfo.Leader
+
+	// Only the leader answers, followers already told who it is.
+	if info.LeaderID == "" {
+		var leader struct {
+			Leader string `json:"leader"`
+		}
+		if err := describeJSON(ctx, client, "stats/leader", info, &leader); err != nil {
+			fail("stats/leader", err)
+		}
+		info.LeaderID = leader.Leader
+	}
+
+	if err := ctx.Err(); err != nil {
+		return info, err
+	}
+	if len(failed) > 0 {
+		return info, fmt.Errorf("could not describe the cluster: %s", strings.Join(failed, "; "))
+	}
+	return info, nil
+}
+
+// describeGet returns the answer of endpoint, and keeps the raft term it
+// reports, if any.
+func describeGet(ctx context.Context, client *etcd.Client, endpoint string, info *ClusterInfo) ([]byte, error) {
+	raw, err := send(ctx, client, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if raw.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", raw.StatusCode)
+	}
+	if term, err := strconv.ParseUint(raw.Header.Get("X-Raft-Term"), 10, 64); err == nil && term > info.RaftTerm {
+		info.RaftTerm = term
+	}
+	return raw.Body, nil
+}
+
+// describeJSON decodes the JSON answer of endpoint into v.
+func describeJSON(ctx context.Context, client *etcd.Client, endpoint string, info *ClusterInfo, v interface{}) error {
+	body, err := describeGet(ctx, client, endpoint, info)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// differences lists what sets the target cluster widely apart from the one
+// the archive was taken from: another major or minor server version, or more
+// than one member more or less. Unknown versions aren't compared.
+func (info *ClusterInfo) differences(target *ClusterInfo) []string {
+	var differences []string
+	if info.Version != "" && target.Version != "" && minorVersion(info.Version) != minorVersion(target.Version) {
+		differences = append(differences, fmt.Sprintf("the archive was taken from etcd %s, the cluster runs etcd %s", info.Version, target.Version))
+	}
+	if len(info.Members) > 0 && len(target.Members) > 0 {
+		if delta := len(info.Members) - len(target.Members); delta > 1 || delta < -1 {
+			differences = append(differences, fmt.Sprintf("the archive was taken from %d members, the cluster has %d", len(info.Members), len(target.Members)))
+		}
+	}
+	return differences
+}
+
+// minorVersion trims a version down to its major and minor numbers.
+func minorVersion(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"sort"
+)
+
+// Kinds of changes between two trees.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// Change is a key that differs between two trees. Indexes don't count, only
+// values, expirations and whether the key is a directory.
+type Change struct {
+	Key  string `json:"key"`
+	Kind string `json:"kind"`
+	// Dir is set when the key is a directory after the change, or was one
+	// before it was removed.
+	Dir bool `json:"dir,omitempty"`
+	// From and To are the values before and after the change.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// Diff returns the changes from the archive read from from to the one read
+// from to, sorted by key.
+func Diff(ctx context.Context, from, to io.Reader) ([]Change, error) {
+	fromRoot, _, err := ReadArchive(from)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive: %v", err)
+	}
+	toRoot, _, err := ReadArchive(to)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return DiffNodes(fromRoot, toRoot), nil
+}
+
+// DiffCluster returns the changes from the archive read from r to the
+// cluster as it is now, sorted by key.
+func DiffCluster(ctx context.Context, cluster Cluster, r io.Reader) ([]Change, error) {
+	root, _, err := ReadArchive(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive: %v", err)
+	}
+
+	client := cluster.Client()
+	defer client.Close()
+	current, err := Fetch(ctx, client, cluster.FetchWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve etcd root node: %v", err)
+	}
+	return DiffNodes(root, current.Node), nil
+}
+
+// DiffNodes returns the changes from the tree below from to the one below
+// to, sorted by key. A directory that was added or removed is a single
+// change, not one per key below it.
+func DiffNodes(from, to *etcd.Node) []Change {
+	fromNodes := map[string]*etcd.Node{}
+	Walk(from, func(node *etcd.Node) {
+		fromNodes[node.Key] = node
+	})
+	toNodes := map[string]*etcd.Node{}
+	Walk(to, func(node *etcd.Node) {
+		toNodes[node.Key] = node
+	})
+
+	var changes []Change
+	var added, removed []string
+	for key, node := range fromNodes {
+		if len(key) == 0 {
+			continue
+		}
+		other, ok := toNodes[key]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Key: key, Kind: ChangeRemoved, Dir: node.Dir, From: node.Value})
+			if node.Dir {
+				removed = append(removed, key)
+			}
+		case !sameNode(node, other):
+			changes = append(changes, Change{Key: key, Kind: ChangeChanged, Dir: other.Dir, From: node.Value, To: other.Value})
+		}
+	}
+	for key, node := range toNodes {
+		if _, ok := fromNodes[key]; ok || len(key) == 0 {
+			continue
+		}
+		changes = append(changes, Change{Key: key, Kind: ChangeAdded, Dir: node.Dir, To: node.Value})
+		if node.Dir {
+			added = append(added, key)
+		}
+	}
+
+	// Keep the topmost of added and removed directories only.
+	var kept []Change
+	for _, change := range changes {
+		switch {
+		case change.Kind == ChangeRemoved && belowParent(change.Key, removed):
+		case change.Kind == ChangeAdded && belowParent(change.Key, added):
+		default:
+			kept = append(kept, change)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Key < kept[j].Key })
+	return kept
+}
+
+// sameNode compares what an archive of the nodes would hold, not counting
+// the keys below directories.
+func sameNode(a, b *etcd.Node) bool {
+	if a.Dir != b.Dir || a.Value != b.Value {
+		return false
+	}
+	if a.Expiration == nil || b.Expiration == nil {
+		return a.Expiration == b.Expiration
+	}
+	return a.Expiration.Unix() == b.Expiration.Unix()
+}
+
+// belowParent reports whether key is strictly below one of prefixes.
+func belowParent(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if key != prefix && below(key, []string{prefix}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	srv := newTestServer(t)
+	before, _ := snapshot(t, srv, Redaction{})
+
+	srv.Set("/apps/web/config", `{"port": 9090}`, 0)
+	srv.Delete("/apps/db")
+	srv.Set("/apps/cache/config", `{"port": 6379}`, 0)
+	srv.Set("/apps/cache/size", "1g", 0)
+	// Rewriting a value as is only moves its indexes.
+	srv.Set("/top", "level", 0)
+	after, _ := snapshot(t, srv, Redaction{})
+
+	want := []Change{
+		{Key: "/apps/cache", Kind: ChangeAdded, Dir: true},
+		{Key: "/apps/db", Kind: ChangeRemoved, Dir: true},
+		{Key: "/apps/web/config", Kind: ChangeChanged, From: `{"port": 8080}`, To: `{"port": 9090}`},
+	}
+	changes, err := Diff(context.Background(), bytes.NewReader(before), bytes.NewReader(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("diff = %+v, want %+v", changes, want)
+	}
+
+	changes, err = DiffCluster(context.Background(), Cluster{Machines: srv.Machines()}, bytes.NewReader(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("diff with the cluster = %+v, want %+v", changes, want)
+	}
+
+	changes, err = Diff(context.Background(), bytes.NewReader(after), bytes.NewReader(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("archive differs from itself: %+v", changes)
+	}
+}
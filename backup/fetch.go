@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"sort"
+	"sync"
+)
+
+// How many times a directory-by-directory walk is retried when the cluster
+// changes underneath it.
+const fetchAttempts = 3
+
+// Fetch retrieves the whole tree, in a single recursive request unless
+// workers is positive.
+func Fetch(ctx context.Context, client *etcd.Client, workers int) (*etcd.Response, error) {
+	if workers <= 0 {
+		return get(ctx, client, "/", false, true)
+	}
+
+	var response *etcd.Response
+	for attempt := 1; attempt <= fetchAttempts; attempt++ {
+		var changed bool
+		var err error
+		if response, changed, err = fetchTree(ctx, client, workers); err != nil {
+			return nil, err
+		}
+		if !changed {
+			return response, nil
+		}
+
+		log.WithField("attempt", attempt).Warn("cluster changed while fetching, retrying")
+	}
+
+	log.Warn("cluster kept changing while fetching, the snapshot may mix several indexes")
+	return response, nil
+}
+
+// fetchTree walks the tree one directory at a time, with workers requests in
+// flight. changed reports whether any key below the root was modified after
+// the walk started, or a directory went away, i.e. whether the tree may not
+// be a consistent snapshot. Writes elsewhere in the cluster, such as those
+// of etcdbk to its hidden lock and status keys, don't count. Neither do
+// deletions of values, which leave no trace in the directories walked.
+func fetchTree(ctx context.Context, client *etcd.Client, workers int) (response *etcd.Response, changed bool, err error) {
+	response, err = get(ctx, client, "/", true, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := &treeFetcher{
+		ctx:       ctx,
+		cancel:    cancel,
+		etcdIndex: response.EtcdIndex,
+	}
+	f.more = sync.NewCond(&f.mu)
+	f.fill(response.Node, response.Node.Nodes)
+
+	// A client fails over by rewriting its cluster, so workers can't share
+	// one: each has a client of its own.
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		worker, err := cloneClient(client)
+		if err != nil {
+			f.mu.Lock()
+			f.fail(fmt.Errorf("could not set up fetch workers: %v", err))
+			f.mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer worker.Close()
+			f.work(worker)
+		}()
+	}
+	wg.Wait()
+
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	return response, f.changed, nil
+}
+
+// cloneClient returns a client with the configuration and machines of
+// client, sharing no state with it.
+func cloneClient(client *etcd.Client) (*etcd.Client, error) {
+	config, err := json.Marshal(client)
+	if err != nil {
+		return nil, err
+	}
+	clone, err := etcd.NewClientFromReader(bytes.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+	clone.CheckRetry = client.CheckRetry
+	return clone, nil
+}
+
+type treeFetcher struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	etcdIndex uint64
+
+	mu sync.Mutex
+	// more is signaled when directories are queued, or the walk ends.
+	more *sync.Cond
+	// queued are the directories left to fetch, active how many are being
+	// fetched.
+	queued  []*etcd.Node
+	active  int
+	changed bool
+	err     error
+}
+
+// fill sets the children of dir, sorted by key, and queues every
+// subdirectory. Called with f.mu held.
+func (f *treeFetcher) fill(dir *etcd.Node, nodes etcd.Nodes) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	dir.Nodes = nodes
+
+	for _, node := range nodes {
+		if node.ModifiedIndex > f.etcdIndex {
+			f.changed = true
+		}
+		if node.Dir {
+			f.queued = append(f.queued, node)
+		}
+	}
+	f.more.Broadcast()
+}
+
+// fail stops the walk on its first error, canceling the requests in flight.
+// Called with f.mu held.
+func (f *treeFetcher) fail(err error) {
+	if f.err == nil {
+		f.err = err
+		f.cancel()
+	}
+	f.more.Broadcast()
+}
+
+// work fetches queued directories with client until none are left, or the
+// walk failed.
+func (f *treeFetcher) work(client *etcd.Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		for len(f.queued) == 0 && f.active > 0 && f.err == nil {
+			f.more.Wait()
+		}
+		if len(f.queued) == 0 || f.err != nil {
+			return
+		}
+
+		dir := f.queued[len(f.queued)-1]
+		f.queued = f.queued[:len(f.queued)-1]
+		f.active++
+		f.mu.Unlock()
+		response, err := get(f.ctx, client, dir.Key, true, false)
+		f.mu.Lock()
+		f.active--
+		f.fetched(dir, response, err)
+		if f.active == 0 && len(f.queued) == 0 {
+			f.more.Broadcast()
+		}
+	}
+}
+
+// fetched records the answer to the request for dir. Called with f.mu held.
+func (f *treeFetcher) fetched(dir *etcd.Node, response *etcd.Response, err error) {
+	if f.err != nil {
+		return
+	}
+	switch {
+	case IsEtcdError(err, EtcdErrKeyNotFound):
+		// Deleted since its parent was listed.
+		f.changed = true
+		return
+	case err != nil:
+		f.fail(fmt.Errorf("could not retrieve %s: %v", dir.Key, err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"key":   dir.Key,
+		"nodes": len(response.Node.Nodes),
+	}).Debug("fetched directory")
+	f.fill(dir, response.Node.Nodes)
+}
@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// flatten lists the keys under node, with the values of files.
+func flatten(node *etcd.Node, into map[string]string) map[string]string {
+	if into == nil {
+		into = map[string]string{}
+	}
+	for _, child := range node.Nodes {
+		if child.Dir {
+			into[child.Key+"/"] = ""
+			flatten(child, into)
+			continue
+		}
+		into[child.Key] = child.Value
+	}
+	return into
+}
+
+func TestFetch(t *testing.T) {
+	srv := etcdtest.NewServer()
+	defer srv.Close()
+	for i := 0; i < 20; i++ {
+		srv.Set(fmt.Sprintf("/apps/app-%d/config", i), fmt.Sprintf("config %d", i), 0)
+		srv.Set(fmt.Sprintf("/apps/app-%d/hosts/web-1", i), "10.0.0.1", 0)
+	}
+	srv.Set("/top", "level", 0)
+
+	client := etcd.NewClient(srv.Machines())
+	whole, err := Fetch(context.Background(), client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := flatten(whole.Node, nil)
+	if len(want) != 20*4+2 {
+		t.Fatalf("single request fetched %d nodes, want %d", len(want), 20*4+2)
+	}
+
+	for _, workers := range []int{1, 4, 100} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			walked, err := Fetch(context.Background(), client, workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if walked.EtcdIndex != whole.EtcdIndex {
+				t.Errorf("EtcdIndex = %d, want %d", walked.EtcdIndex, whole.EtcdIndex)
+			}
+			if got := flatten(walked.Node, nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("walk fetched %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// newProxy starts a proxy to srv until the test ends, calling intercept on
+// every request first. Requests intercept answers go no further.
+func newProxy(t *testing.T, srv *etcdtest.Server, intercept func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	t.Helper()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httputil.NewSingleHostReverseProxy(target)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !intercept(w, r) {
+			upstream.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestFetchChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		// write changes srv while /apps/web is being fetched.
+		write   func(srv *etcdtest.Server)
+		retried bool
+	}{
+		{
+			name:  "hidden bookkeeping key",
+			write: func(srv *etcdtest.Server) { srv.Set("/_etcdbk/status", "ok", 0) },
+		},
+		{
+			name:    "key below the root",
+			write:   func(srv *etcdtest.Server) { srv.Set("/apps/db/config", `{"port": 6543}`, 0) },
+			retried: true,
+		},
+		{
+			name:    "directory deleted",
+			write:   func(srv *etcdtest.Server) { srv.Delete("/apps/db") },
+			retried: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			var walks int32
+			var once sync.Once
+			proxy := newProxy(t, srv, func(w http.ResponseWriter, r *http.Request) bool {
+				switch {
+				case r.URL.Path == "/v2/keys/":
+					atomic.AddInt32(&walks, 1)
+				case r.URL.Path == "/v2/keys/apps/web":
+					once.Do(func() { tt.write(srv) })
+				}
+				return false
+			})
+
+			client := etcd.NewClient([]string{proxy.URL})
+			defer client.Close()
+			// One worker fetches /apps/web before /apps/db.
+			response, err := Fetch(context.Background(), client, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retried := atomic.LoadInt32(&walks) > 1; retried != tt.retried {
+				t.Errorf("walk retried: %t, want %t", retried, tt.retried)
+			}
+			if !tt.retried && response.EtcdIndex == srv.Index() {
+				t.Errorf("walk at index %d, want the one before the write", response.EtcdIndex)
+			}
+		})
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	srv := etcdtest.NewServer()
+	defer srv.Close()
+	for i := 0; i < 50; i++ {
+		srv.Set(fmt.Sprintf("/apps/app-%d/config", i), "config", 0)
+	}
+
+	var fetched int32
+	proxy := newProxy(t, srv, func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/v2/keys/apps/") {
+			return false
+		}
+		atomic.AddInt32(&fetched, 1)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"errorCode": 110, "message": "The request requires user authentication"}`)
+		return true
+	})
+
+	client := etcd.NewClient([]string{proxy.URL})
+	defer client.Close()
+	_, err := Fetch(context.Background(), client, 4)
+	if err == nil || !strings.Contains(err.Error(), "user authentication") {
+		t.Errorf("err = %v, want the error of the directory", err)
+	}
+	// The walk stops on the first error, with at most the other workers'
+	// requests already sent.
+	if n := atomic.LoadInt32(&fetched); n > 4 {
+		t.Errorf("fetched %d directories after the first error, want at most 4", n)
+	}
+}
+
+func TestCloneClient(t *testing.T) {
+	client := etcd.NewClient([]string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"})
+	clone, err := cloneClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone == client {
+		t.Fatal("clone is the client")
+	}
+	if !reflect.DeepEqual(clone.GetCluster(), client.GetCluster()) {
+		t.Errorf("clone machines = %v, want %v", clone.GetCluster(), client.GetCluster())
+	}
+
+	// Failing over rewrites the machines of one client only.
+	client.GetCluster()[0] = "http://10.0.0.3:2379"
+	if got := clone.GetCluster()[0]; got != "http://10.0.0.1:2379" {
+		t.Errorf("clone machines moved along with the client's, to %s", got)
+	}
+}
@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"time"
+)
+
+// ContentHash digests what an archive of node holds: keys, values and
+// expirations, but not the indexes, so that setting a key to the value it
+// already had doesn't count as a change. Keys of ignored are left out.
+func ContentHash(node *etcd.Node, ignored []string) string {
+	return contentHash(node, ignored, nil)
+}
+
+// contentHash is ContentHash with values redacted by r.
+func contentHash(node *etcd.Node, ignored []string, r *Redactor) string {
+	hash := sha256.New()
+	writeContent(hash, node, ignored, r)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func writeContent(w io.Writer, node *etcd.Node, ignored []string, r *Redactor) {
+	for _, key := range ignored {
+		if node.Key == key {
+			return
+		}
+	}
+
+	expiration := ""
+	if node.Expiration != nil {
+		expiration = node.Expiration.UTC().Format(time.RFC3339)
+	}
+	if node.Dir {
+		fmt.Fprintf(w, "d %q %s\n", node.Key, expiration)
+		for _, subNode := range sortedNodes(node.Nodes) {
+			writeContent(w, subNode, ignored, r)
+		}
+		return
+	}
+	fmt.Fprintf(w, "v %q %s %q\n", node.Key, expiration, r.redact(node.Key, node.Value))
+}
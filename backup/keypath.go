@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Longest path element most file systems accept.
+const maxPathElement = 255
+
+// keyPath turns a key into a relative archive path that is safe to extract.
+// Every element of the key is escaped on its own:
+//
+//   - control characters, backslashes and % become %XX, like in URLs
+//   - . and .. have their dots escaped
+//   - an empty element, as in "/a//b", becomes %-
+//   - an element too long for file systems is cut, and ends with %~ and a
+//     hash of the whole element
+//
+// Safe keys map to themselves without the leading slash. Everything but cut
+// elements can be reversed with pathKey; archives also keep the key itself
+// in a PAX record whenever it differs from its path.
+func keyPath(key string) string {
+	elements := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	for i, element := range elements {
+		elements[i] = escapePathElement(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+func escapePathElement(element string) string {
+	switch element {
+	case "":
+		return "%-"
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+
+	var escaped bytes.Buffer
+	for i := 0; i < len(element); i++ {
+		c := element[i]
+		if c < 0x20 || c == 0x7f || c == '%' || c == '\\' {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+	if escaped.Len() <= maxPathElement {
+		return escaped.String()
+	}
+
+	sum := sha256.Sum256([]byte(element))
+	suffix := "%~" + hex.EncodeToString(sum[:8])
+	cut := escaped.String()[:maxPathElement-len(suffix)]
+	// Don't leave half an escape behind.
+	if i := strings.LastIndexByte(cut, '%'); i >= len(cut)-2 {
+		cut = cut[:i]
+	}
+	return cut + suffix
+}
+
+// pathKey reverses keyPath. It fails on paths that keyPath wouldn't have
+// written, and on cut elements.
+func pathKey(p string) (string, error) {
+	elements := strings.Split(p, "/")
+	for i, element := range elements {
+		if element == "%-" {
+			elements[i] = ""
+			continue
+		}
+
+		var key bytes.Buffer
+		for j := 0; j < len(element); j++ {
+			if element[j] != '%' {
+				key.WriteByte(element[j])
+				continue
+			}
+			if j+2 >= len(element) {
+				return "", fmt.Errorf("invalid escape in %q", p)
+			}
+			c, err := hex.DecodeString(element[j+1 : j+3])
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in %q", p)
+			}
+			key.WriteByte(c[0])
+			j += 2
+		}
+		elements[i] = key.String()
+	}
+
+	key := "/" + strings.Join(elements, "/")
+	if keyPath(key) != p {
+		return "", fmt.Errorf("%q is not an escaped key", p)
+	}
+	return key, nil
+}
+
+// checkEntryPath rejects archive paths that would land outside of the
+// directory an archive is extracted to, or that tools would read differently.
+func checkEntryPath(p string) error {
+	switch {
+	case p == "":
+		return fmt.Errorf("empty archive path")
+	case strings.HasPrefix(p, "/"):
+		return fmt.Errorf("absolute archive path %q", p)
+	case strings.ContainsAny(p, "\\\x00"):
+		return fmt.Errorf("archive path %q contains a backslash or a NUL byte", p)
+	}
+
+	for _, element := range strings.Split(p, "/") {
+		if element == "" || element == "." || element == ".." {
+			return fmt.Errorf("archive path %q has an empty, . or .. element", p)
+		}
+	}
+	return nil
+}
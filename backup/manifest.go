@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// PAX records of the archive manifest.
+const (
+	manifestRedacted  = "ETCDBK.redacted"
+	manifestTime      = "ETCDBK.time"
+	manifestEtcdIndex = "ETCDBK.etcdIndex"
+	manifestKeys      = "ETCDBK.keys"
+	manifestDigest    = "ETCDBK.digest"
+	manifestVersion   = "ETCDBK.cluster.version"
+	manifestMembers   = "ETCDBK.cluster.members"
+	manifestLeader    = "ETCDBK.cluster.leader"
+	manifestRaftTerm  = "ETCDBK.cluster.raftTerm"
+)
+
+// Manifest describes an archive. It is written as a PAX global header ahead
+// of the keys, which tar tools skip on extraction.
+type Manifest struct {
+	Redacted bool
+	// Time the snapshot was taken, also the modification time of every
+	// entry.
+	Time      time.Time
+	EtcdIndex uint64
+	// Keys is the number of values in the archive, and Digest their
+	// ContentHash, as archived. WriteArchive sets both; archives written by
+	// older versions have neither.
+	Keys   int
+	Digest string
+	// Cluster describes the cluster the snapshot was taken from, nil when
+	// it couldn't be described or the archive predates it. Members are
+	// recorded as JSON.
+	Cluster *ClusterInfo
+}
+
+func (m Manifest) header() *tar.Header {
+	records := map[string]string{
+		manifestRedacted:  strconv.FormatBool(m.Redacted),
+		manifestTime:      m.Time.Format(time.RFC3339),
+		manifestEtcdIndex: strconv.FormatUint(m.EtcdIndex, 10),
+		manifestKeys:      strconv.Itoa(m.Keys),
+		manifestDigest:    m.Digest,
+	}
+	if c := m.Cluster; c != nil {
+		members, _ := json.Marshal(c.Members)
+		records[manifestVersion] = c.Version
+		records[manifestMembers] = string(members)
+		records[manifestLeader] = c.LeaderID
+		records[manifestRaftTerm] = strconv.FormatUint(c.RaftTerm, 10)
+	}
+	return &tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "etcdbk-manifest",
+		PAXRecords: records,
+	}
+}
+
+// readManifest decodes the manifest from a PAX global header. Archives
+// without one decode to the zero manifest.
+func readManifest(hdr *tar.Header) Manifest {
+	var m Manifest
+	if hdr.Typeflag != tar.TypeXGlobalHeader {
+		return m
+	}
+	m.Redacted, _ = strconv.ParseBool(hdr.PAXRecords[manifestRedacted])
+	m.Time, _ = time.Parse(time.RFC3339, hdr.PAXRecords[manifestTime])
+	m.EtcdIndex, _ = strconv.ParseUint(hdr.PAXRecords[manifestEtcdIndex], 10, 64)
+	m.Keys, _ = strconv.Atoi(hdr.PAXRecords[manifestKeys])
+	m.Digest = hdr.PAXRecords[manifestDigest]
+	if members, ok := hdr.PAXRecords[manifestMembers]; ok {
+		c := &ClusterInfo{
+			Version:  hdr.PAXRecords[manifestVersion],
+			LeaderID: hdr.PAXRecords[manifestLeader],
+		}
+		json.Unmarshal([]byte(members), &c.Members)
+		c.RaftTerm, _ = strconv.ParseUint(hdr.PAXRecords[manifestRaftTerm], 10, 64)
+		m.Cluster = c
+	}
+	return m
+}
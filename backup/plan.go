@@ -0,0 +1,208 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"strings"
+	"time"
+)
+
+// Actions of a restore plan.
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionSkip   = "skip"
+)
+
+// Plan lists every write a restore will make, in order.
+type Plan struct {
+	Mode      string `json:"mode"`
+	EtcdIndex uint64 `json:"etcdIndex"`
+	Steps     []Step `json:"steps"`
+}
+
+type Step struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Dir    bool   `json:"dir,omitempty"`
+	// TTL is what the key would get if the plan was applied right away,
+	// Expiration what it gets when the plan is applied.
+	TTL        uint64     `json:"ttl,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	// PrevIndex is the ModifiedIndex of the key when planning, 0 if it
+	// didn't exist.
+	PrevIndex uint64 `json:"prevIndex,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// newPlan compares the archived tree with the current one, and plans
+// the writes that mode calls for. In replace mode, the targets prefixes are
+// deleted first, or the whole keyspace if there are none.
+func newPlan(mode string, archived *etcd.Node, current *etcd.Response, targets []string, now time.Time) *Plan {
+	plan := &Plan{Mode: mode, EtcdIndex: current.EtcdIndex}
+
+	existing := map[string]*etcd.Node{}
+	Walk(current.Node, func(node *etcd.Node) {
+		existing[node.Key] = node
+	})
+
+	if mode == ModeReplace {
+		wiped := current.Node.Nodes
+		if targets != nil {
+			wiped = nil
+			for _, target := range targets {
+				if node := existing[target]; node != nil {
+					wiped = append(wiped, node)
+				}
+			}
+		}
+
+		var deleted []string
+		for _, node := range wiped {
+			plan.Steps = append(plan.Steps, Step{
+				Action:    ActionDelete,
+				Key:       node.Key,
+				Dir:       node.Dir,
+				PrevIndex: node.ModifiedIndex,
+			})
+			deleted = append(deleted, node.Key)
+		}
+		for key := range existing {
+			if below(key, deleted) {
+				delete(existing, key)
+			}
+		}
+	}
+
+	Walk(archived, func(node *etcd.Node) {
+		// Values, and directories that would not be created along the way.
+		if (node.Dir && len(node.Nodes) > 0) || len(node.Key) == 0 {
+			return
+		}
+
+		step := Step{
+			Action:     ActionCreate,
+			Key:        node.Key,
+			Value:      node.Value,
+			Dir:        node.Dir,
+			Expiration: node.Expiration,
+		}
+		ttl, expired := RemainingTTL(node.Expiration, now)
+		step.TTL = ttl
+
+		cur := existing[node.Key]
+		if cur != nil {
+			step.PrevIndex = cur.ModifiedIndex
+		}
+		switch {
+		case expired:
+			step.Action, step.Reason = ActionSkip, "expired"
+		case cur == nil:
+		case node.Dir || mode == ModeSkipExisting:
+			step.Action, step.Reason = ActionSkip, "exists"
+		default:
+			step.Action = ActionUpdate
+		}
+		plan.Steps = append(plan.Steps, step)
+	})
+
+	return plan
+}
+
+// moved returns the keys that changed since the plan was made, including
+// those written below a directory the plan deletes.
+func (p *Plan) moved(current *etcd.Node) []string {
+	existing := map[string]uint64{}
+	var written []string
+	Walk(current, func(node *etcd.Node) {
+		existing[node.Key] = node.ModifiedIndex
+		if node.ModifiedIndex > p.EtcdIndex {
+			written = append(written, node.Key)
+		}
+	})
+
+	var deleted []string
+	var moved []string
+	for _, step := range p.Steps {
+		if step.Action == ActionSkip || below(step.Key, deleted) {
+			continue
+		}
+		if existing[step.Key] != step.PrevIndex {
+			moved = append(moved, step.Key)
+		}
+		if step.Action == ActionDelete {
+			deleted = append(deleted, step.Key)
+		}
+		if step.Action == ActionDelete && step.Dir {
+			// etcd can't compare a directory before deleting it, so whatever
+			// was written below it must be caught now.
+			for _, key := range written {
+				if key != step.Key && below(key, []string{step.Key}) {
+					moved = append(moved, key)
+				}
+			}
+		}
+	}
+	return moved
+}
+
+// below reports whether key is one of prefixes, or below one of them.
+func below(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteText prints the plan a step per line, followed by a summary.
+func (p *Plan) WriteText(out io.Writer) {
+	counts := map[string]int{}
+	for _, step := range p.Steps {
+		counts[step.Action]++
+
+		line := fmt.Sprintf("%-10s %s", step.Action, step.Key)
+		if step.Dir && step.Action != ActionDelete {
+			line += "/"
+		}
+		if step.TTL > 0 && step.Action != ActionSkip {
+			line += fmt.Sprintf(" (ttl %ds)", step.TTL)
+		}
+		if step.Reason != "" {
+			line += fmt.Sprintf(" (%s)", step.Reason)
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	fmt.Fprintf(out, "%d to create, %d to update, %d to delete, %d to skip, at etcd index %d\n",
+		counts[ActionCreate],
+		counts[ActionUpdate],
+		counts[ActionDelete],
+		counts[ActionSkip],
+		p.EtcdIndex,
+	)
+}
+
+// WriteJSON writes the plan as JSON, for ReadPlan.
+func (p *Plan) WriteJSON(out io.Writer) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+// ReadPlan decodes a plan written by WriteJSON.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	plan := new(Plan)
+	if err := json.NewDecoder(r).Decode(plan); err != nil {
+		return nil, fmt.Errorf("could not decode restore plan: %v", err)
+	}
+	return plan, nil
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Redaction says which values to redact, and how.
+type Redaction struct {
+	// Globs of keys whose values are redacted, e.g. /app/*/password. A glob
+	// without a slash matches the last element of the key.
+	Globs []string
+	// Builtin also redacts common secrets: PEM blocks, AWS keys, and keys
+	// named like passwords, secrets or tokens.
+	Builtin bool
+	// Mode is "marker" to replace values with Marker, or "hash" to replace
+	// them with a hash salted with Salt, random if empty. The default is
+	// "marker".
+	Mode   string
+	Marker string
+	Salt   string
+}
+
+// Default redaction marker.
+const DefaultRedactMarker = "REDACTED"
+
+// Key names redacted by Builtin, matched against the lower-cased last
+// element of the key.
+var builtinRedactNames = []string{
+	"*password*",
+	"*passwd*",
+	"*secret*",
+	"*token*",
+	"*credential*",
+	"*private*key*",
+	"*api*key*",
+}
+
+// Value shapes redacted by Builtin, whatever the key.
+var builtinRedactValues = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----`),
+	regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`(?i)aws_secret_access_key`),
+}
+
+// Redactor replaces the values of matching keys. A nil Redactor leaves
+// every value alone.
+type Redactor struct {
+	globs   []string
+	builtin bool
+	marker  string
+	salt    []byte // hash values with this salt instead of using marker
+}
+
+// NewRedactor returns nil when no redaction is asked for.
+func NewRedactor(o Redaction) (*Redactor, error) {
+	if len(o.Globs) == 0 && !o.Builtin {
+		return nil, nil
+	}
+
+	for _, glob := range o.Globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid redact glob %q: %v", glob, err)
+		}
+	}
+
+	r := &Redactor{
+		globs:   o.Globs,
+		builtin: o.Builtin,
+		marker:  o.Marker,
+	}
+	if r.marker == "" {
+		r.marker = DefaultRedactMarker
+	}
+	switch o.Mode {
+	case "", "marker":
+	case "hash":
+		r.salt = []byte(o.Salt)
+		if len(r.salt) == 0 {
+			r.salt = make([]byte, 16)
+			if _, err := rand.Read(r.salt); err != nil {
+				return nil, fmt.Errorf("could not generate a redaction salt: %v", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown redact mode %q, expected marker or hash", o.Mode)
+	}
+
+	return r, nil
+}
+
+// matches reports whether the value of key should be redacted.
+func (r *Redactor) matches(key, value string) bool {
+	base := path.Base(key)
+	for _, glob := range r.globs {
+		name := key
+		if !strings.Contains(glob, "/") {
+			name = base
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+
+	if !r.builtin {
+		return false
+	}
+	lower := strings.ToLower(base)
+	for _, glob := range builtinRedactNames {
+		if ok, _ := path.Match(glob, lower); ok {
+			return true
+		}
+	}
+	for _, re := range builtinRedactValues {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns the value to archive for key.
+func (r *Redactor) redact(key, value string) string {
+	if r == nil || !r.matches(key, value) {
+		return value
+	}
+	if r.salt == nil {
+		return r.marker
+	}
+
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
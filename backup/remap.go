@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Remap picks the archived keys to restore, and where to restore them.
+type Remap struct {
+	// Only restores the keys below these prefixes, all of them if empty.
+	Only []string
+	// FromPrefix only restores the keys below it, moving them to ToPrefix.
+	// Both default to /.
+	FromPrefix string
+	ToPrefix   string
+	// Rewrite rewrites restored keys with rules written
+	// REGEXP=>REPLACEMENT, after moving them to ToPrefix. $1 and so on refer
+	// to groups.
+	Rewrite []string
+}
+
+type keyMapper struct {
+	only       []string
+	fromPrefix string
+	toPrefix   string
+	rewrites   []keyRewrite
+}
+
+type keyRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newKeyMapper cleans the prefixes, and parses the rewrite rules.
+func newKeyMapper(r Remap) (*keyMapper, error) {
+	m := &keyMapper{
+		fromPrefix: cleanKey(r.FromPrefix),
+		toPrefix:   cleanKey(r.ToPrefix),
+	}
+	for _, prefix := range r.Only {
+		m.only = append(m.only, cleanKey(prefix))
+	}
+
+	for _, rule := range r.Rewrite {
+		parts := strings.SplitN(rule, "=>", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rewrite rule %q, expected REGEXP=>REPLACEMENT", rule)
+		}
+		pattern, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: %v", rule, err)
+		}
+		m.rewrites = append(m.rewrites, keyRewrite{pattern: pattern, replacement: parts[1]})
+	}
+
+	return m, nil
+}
+
+// cleanKey turns prefixes like "prod/app/" into "/prod/app".
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+// mapKey returns where to restore key, or false if it isn't restored.
+func (m *keyMapper) mapKey(key string) (string, bool) {
+	if len(m.only) > 0 && !below(key, m.only) {
+		return "", false
+	}
+
+	if m.fromPrefix != "/" {
+		if !below(key, []string{m.fromPrefix}) {
+			return "", false
+		}
+		key = strings.TrimPrefix(key, m.fromPrefix)
+	}
+	key = path.Join(m.toPrefix, key)
+
+	for _, rewrite := range m.rewrites {
+		key = rewrite.pattern.ReplaceAllString(key, rewrite.replacement)
+	}
+	key = cleanKey(key)
+	if key == "/" {
+		return "", false
+	}
+	return key, true
+}
+
+// targets returns the prefixes a restore writes to, nil meaning the whole
+// keyspace. Rewrites could send keys anywhere, so they're not accounted for.
+func (m *keyMapper) targets() []string {
+	targets := []string{}
+	if len(m.only) == 0 {
+		targets = append(targets, m.fromPrefix)
+	}
+	for _, prefix := range m.only {
+		switch {
+		case below(prefix, []string{m.fromPrefix}):
+			targets = append(targets, prefix)
+		case below(m.fromPrefix, []string{prefix}):
+			targets = append(targets, m.fromPrefix)
+		}
+	}
+
+	for i, target := range targets {
+		if m.fromPrefix != "/" {
+			target = strings.TrimPrefix(target, m.fromPrefix)
+		}
+		targets[i] = cleanKey(path.Join(m.toPrefix, target))
+	}
+	if len(targets) == 1 && targets[0] == "/" {
+		return nil
+	}
+	return targets
+}
+
+// remap rebuilds the tree below root with the restored keys only, at their
+// new places.
+func (m *keyMapper) remap(root *etcd.Node) *etcd.Node {
+	mapped := &etcd.Node{Dir: true}
+	dirs := map[string]*etcd.Node{"/": mapped}
+	values := map[string]bool{}
+
+	Walk(root, func(node *etcd.Node) {
+		// Values, and directories that would not be created along the way.
+		if (node.Dir && len(node.Nodes) > 0) || len(node.Key) == 0 {
+			return
+		}
+
+		key, ok := m.mapKey(node.Key)
+		if !ok {
+			log.WithField("key", node.Key).Debug("not restoring key")
+			return
+		}
+		if values[key] {
+			log.WithFields(log.Fields{
+				"key":    node.Key,
+				"mapped": key,
+			}).Warn("several keys are restored to the same place, the last one wins")
+		}
+		values[key] = true
+
+		if node.Dir {
+			n := dirNode(dirs, key)
+			n.Expiration = node.Expiration
+			return
+		}
+		n := *node
+		n.Key = key
+		parent := dirNode(dirs, path.Dir(key))
+		parent.Nodes = append(parent.Nodes, &n)
+	})
+
+	return mapped
+}
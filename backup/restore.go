@@ -0,0 +1,284 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Restore modes, deciding what happens to keys that already exist.
+const (
+	ModeMerge                = "merge"
+	ModeSkipExisting         = "skip-existing"
+	ModeOverwriteIfUnchanged = "overwrite-if-unchanged"
+	ModeReplace              = "replace"
+)
+
+// Outcomes of restoring a key.
+const (
+	ResultCreated    = "created"
+	ResultUpdated    = "updated"
+	ResultSkipped    = "skipped"
+	ResultConflicted = "conflicted"
+	ResultDeleted    = "deleted"
+)
+
+type RestoreConfig struct {
+	Cluster Cluster
+	// Mode decides what to do with existing keys: ModeMerge sets every key,
+	// ModeSkipExisting leaves existing keys alone, ModeOverwriteIfUnchanged
+	// compares-and-swaps against the index read before restoring, and
+	// ModeReplace deletes the target prefixes first. The default is
+	// ModeMerge.
+	Mode string
+	// AllowRedacted restores redacted archives, writing their placeholders
+	// over real values.
+	AllowRedacted bool
+	Remap         Remap
+	// Report, if set, gets the outcome of every key as it is restored, and
+	// a summary.
+	Report io.Writer
+}
+
+func (cfg *RestoreConfig) check() (*keyMapper, error) {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeMerge
+	case ModeMerge, ModeSkipExisting, ModeOverwriteIfUnchanged, ModeReplace:
+	default:
+		return nil, fmt.Errorf("unknown restore mode %q, expected merge, skip-existing, overwrite-if-unchanged or replace", cfg.Mode)
+	}
+
+	mapper, err := newKeyMapper(cfg.Remap)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mode == ModeReplace && len(cfg.Remap.Rewrite) > 0 {
+		return nil, fmt.Errorf("the replace mode can't tell which keys to delete when keys are rewritten")
+	}
+	return mapper, nil
+}
+
+// Restore writes the keys of the archive read from r back into the cluster.
+func Restore(ctx context.Context, cfg RestoreConfig, r io.Reader) (*Report, error) {
+	client := cfg.Cluster.Client()
+	defer client.Close()
+
+	plan, err := planRestore(ctx, client, &cfg, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only skip-existing and overwrite-if-unchanged care whether keys changed
+	// since they were read.
+	guarded := cfg.Mode == ModeSkipExisting || cfg.Mode == ModeOverwriteIfUnchanged
+	return applyPlan(ctx, client, plan, guarded, cfg.Report)
+}
+
+// PlanRestore returns what Restore would do, without writing anything.
+func PlanRestore(ctx context.Context, cfg RestoreConfig, r io.Reader) (*Plan, error) {
+	client := cfg.Cluster.Client()
+	defer client.Close()
+
+	return planRestore(ctx, client, &cfg, r)
+}
+
+func planRestore(ctx context.Context, client *etcd.Client, cfg *RestoreConfig, r io.Reader) (*Plan, error) {
+	mapper, err := cfg.check()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := Fetch(ctx, client, cfg.Cluster.FetchWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve etcd root node: %v", err)
+	}
+
+	root, m, err := ReadArchive(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive: %v", err)
+	}
+	if m.Redacted && !cfg.AllowRedacted {
+		return nil, ErrRedacted
+	}
+	warnDifferences(ctx, client, m.Cluster)
+
+	return newPlan(cfg.Mode, mapper.remap(root), current, mapper.targets(), time.Now()), nil
+}
+
+// warnDifferences logs a warning when the cluster of client is widely apart
+// from archived, the cluster the archive was taken from, if known. Restoring
+// into another version or size of cluster is legitimate, but worth a second
+// look.
+func warnDifferences(ctx context.Context, client *etcd.Client, archived *ClusterInfo) {
+	if archived == nil {
+		return
+	}
+	target, err := Describe(ctx, client)
+	if err != nil {
+		log.WithField("error", err).Debug("could not fully describe the cluster to restore into")
+	}
+	for _, difference := range archived.differences(target) {
+		log.WithField("difference", difference).Warn("the cluster differs from the one the archive was taken from")
+	}
+}
+
+// ErrRedacted is returned when restoring a redacted archive without
+// AllowRedacted.
+var ErrRedacted = errors.New("the archive is redacted, restoring it would write placeholders over real values")
+
+// ApplyPlan makes the writes of a plan made by PlanRestore, exactly, unless
+// any of its keys changed since it was made. The mode, remap and redaction
+// options of cfg are not used: the plan already accounts for them.
+func ApplyPlan(ctx context.Context, cfg RestoreConfig, plan *Plan) (*Report, error) {
+	client := cfg.Cluster.Client()
+	defer client.Close()
+
+	current, err := Fetch(ctx, client, cfg.Cluster.FetchWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve etcd root node: %v", err)
+	}
+
+	if moved := plan.moved(current.Node); len(moved) > 0 {
+		if len(moved) > 10 {
+			moved = append(moved[:10], "...")
+		}
+		return nil, fmt.Errorf("the cluster changed since the plan was made at etcd index %d, now %d: %s",
+			plan.EtcdIndex, current.EtcdIndex, strings.Join(moved, ", "))
+	}
+
+	return applyPlan(ctx, client, plan, true, cfg.Report)
+}
+
+// applyPlan makes the writes of plan, reporting the outcome of every step to
+// out. Guarded writes only succeed if the key is still as planned: creates
+// require it not to exist, updates and deletes of values compare-and-swap
+// against its planned index. Rejections by etcd are reported as conflicts,
+// other errors are returned.
+func applyPlan(ctx context.Context, client *etcd.Client, plan *Plan, guarded bool, out io.Writer) (*Report, error) {
+	if out == nil {
+		out = ioutil.Discard
+	}
+	report := &Report{Counts: map[string]int{}, out: out}
+	defer report.summary()
+
+	now := time.Now()
+	for _, step := range plan.Steps {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := applyStep(client, step, guarded, now, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func applyStep(client *etcd.Client, step Step, guarded bool, now time.Time, report *Report) error {
+	if step.Action == ActionSkip {
+		report.add(step.Key, ResultSkipped, step.Reason)
+		return nil
+	}
+
+	ttl, expired := RemainingTTL(step.Expiration, now)
+	if expired && step.Action != ActionDelete {
+		report.add(step.Key, ResultSkipped, "expired")
+		return nil
+	}
+
+	var result string
+	var err error
+	switch step.Action {
+	case ActionDelete:
+		result = ResultDeleted
+		log.WithField("key", step.Key).Debug("deleting before restore")
+		// Directories can't be compared and deleted: ApplyPlan checked
+		// nothing was written below them.
+		if guarded && !step.Dir {
+			_, err = client.CompareAndDelete(step.Key, "", step.PrevIndex)
+		} else {
+			_, err = client.Delete(step.Key, true)
+		}
+	case ActionCreate:
+		result = ResultCreated
+		switch {
+		case step.Dir:
+			if _, err = client.CreateDir(step.Key, ttl); IsEtcdError(err, EtcdErrNodeExist) {
+				report.add(step.Key, ResultSkipped, "exists")
+				return nil
+			}
+		case guarded:
+			_, err = client.Create(step.Key, step.Value, ttl)
+		default:
+			_, err = client.Set(step.Key, step.Value, ttl)
+		}
+	case ActionUpdate:
+		result = ResultUpdated
+		if guarded {
+			_, err = client.CompareAndSwap(step.Key, step.Value, ttl, "", step.PrevIndex)
+		} else {
+			_, err = client.Set(step.Key, step.Value, ttl)
+		}
+	default:
+		return fmt.Errorf("unknown plan action %q for %s", step.Action, step.Key)
+	}
+
+	if etcdErr, ok := err.(*etcd.EtcdError); ok {
+		report.add(step.Key, ResultConflicted, etcdErr.Message)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not %s %s: %v", step.Action, step.Key, err)
+	}
+
+	report.add(step.Key, result, "")
+	return nil
+}
+
+// RemainingTTL returns the TTL left until expiration at now, in whole
+// seconds, and whether it already passed. Without an expiration there is no
+// TTL.
+func RemainingTTL(expiration *time.Time, now time.Time) (ttl uint64, expired bool) {
+	if expiration == nil {
+		return 0, false
+	}
+
+	left := expiration.Sub(now)
+	if left <= 0 {
+		return 0, true
+	}
+	return uint64((left + time.Second - 1) / time.Second), false
+}
+
+// Report counts the outcomes of a restore, by result.
+type Report struct {
+	Counts map[string]int
+
+	// The outcome of every key is printed to out as it happens.
+	out io.Writer
+}
+
+func (r *Report) add(key, result, detail string) {
+	r.Counts[result]++
+	if detail != "" {
+		fmt.Fprintf(r.out, "%-10s %s (%s)\n", result, key, detail)
+	} else {
+		fmt.Fprintf(r.out, "%-10s %s\n", result, key)
+	}
+}
+
+func (r *Report) summary() {
+	fmt.Fprintf(r.out, "%d created, %d updated, %d skipped, %d conflicted, %d deleted\n",
+		r.Counts[ResultCreated],
+		r.Counts[ResultUpdated],
+		r.Counts[ResultSkipped],
+		r.Counts[ResultConflicted],
+		r.Counts[ResultDeleted],
+	)
+}
@@ -0,0 +1,273 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	source := newTestServer(t)
+	client := Cluster{Machines: source.Machines()}.Client()
+	defer client.Close()
+	if _, err := client.CreateDir("/apps/empty", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Set("/sessions/abc", "user-1", 3600); err != nil {
+		t.Fatal(err)
+	}
+	archive, m := snapshot(t, source, Redaction{})
+
+	verified, err := Verify(context.Background(), bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Digest != m.Digest || verified.Keys != 5 {
+		t.Errorf("verified %+v, want %+v", verified, m)
+	}
+
+	target := etcdtest.NewServer()
+	defer target.Close()
+	cfg := RestoreConfig{Cluster: Cluster{Machines: target.Machines()}}
+	if _, err := Restore(context.Background(), cfg, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := target.Keys("/"), source.Keys("/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+
+	restored := cfg.Cluster.Client()
+	defer restored.Close()
+	resp, err := restored.Get("/apps/empty", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Node.Dir {
+		t.Error("empty directory restored as a value")
+	}
+	resp, err = restored.Get("/sessions/abc", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Node.TTL <= 3500 || resp.Node.TTL > 3600 {
+		t.Errorf("TTL = %d after restore, want the hour left", resp.Node.TTL)
+	}
+
+	// A snapshot of the restored cluster holds the same keys.
+	again, _ := snapshot(t, target, Redaction{})
+	changes, err := Diff(context.Background(), bytes.NewReader(archive), bytes.NewReader(again))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		// Restoring rounds the expiration up to the second.
+		if change.Key == "/sessions/abc" && change.Kind == ChangeChanged && change.From == change.To {
+			continue
+		}
+		t.Errorf("restored cluster changed: %+v", change)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	archive, _ := snapshot(t, newTestServer(t), Redaction{})
+
+	tests := []struct {
+		name  string
+		cfg   RestoreConfig
+		want  map[string]string
+		count map[string]int
+	}{
+		{
+			name: "merge",
+			want: map[string]string{
+				"/apps/web/config":   `{"port": 8080}`,
+				"/apps/web/password": "hunter2",
+				"/apps/db/config":    `{"port": 5432}`,
+				"/top":               "level",
+				"/other":             "kept",
+			},
+			count: map[string]int{ResultCreated: 3, ResultUpdated: 1},
+		},
+		{
+			name: "skip existing",
+			cfg:  RestoreConfig{Mode: ModeSkipExisting},
+			want: map[string]string{
+				"/apps/web/config":   `{"port": 9090}`,
+				"/apps/web/password": "hunter2",
+				"/apps/db/config":    `{"port": 5432}`,
+				"/top":               "level",
+				"/other":             "kept",
+			},
+			count: map[string]int{ResultCreated: 3, ResultSkipped: 1},
+		},
+		{
+			name: "replace",
+			cfg:  RestoreConfig{Mode: ModeReplace},
+			want: map[string]string{
+				"/apps/web/config":   `{"port": 8080}`,
+				"/apps/web/password": "hunter2",
+				"/apps/db/config":    `{"port": 5432}`,
+				"/top":               "level",
+			},
+			count: map[string]int{ResultDeleted: 2, ResultCreated: 4},
+		},
+		{
+			name: "remapped",
+			cfg:  RestoreConfig{Remap: Remap{FromPrefix: "/apps/web", ToPrefix: "/staging/web"}},
+			want: map[string]string{
+				"/apps/web/config":      `{"port": 9090}`,
+				"/staging/web/config":   `{"port": 8080}`,
+				"/staging/web/password": "hunter2",
+				"/other":                "kept",
+			},
+			count: map[string]int{ResultCreated: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := etcdtest.NewServer()
+			defer target.Close()
+			target.Set("/apps/web/config", `{"port": 9090}`, 0)
+			target.Set("/other", "kept", 0)
+
+			var out bytes.Buffer
+			tt.cfg.Cluster = Cluster{Machines: target.Machines()}
+			tt.cfg.Report = &out
+			report, err := Restore(context.Background(), tt.cfg, bytes.NewReader(archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := target.Keys("/"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restored %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(report.Counts, tt.count) {
+				t.Errorf("counts = %v, want %v\n%s", report.Counts, tt.count, out.String())
+			}
+		})
+	}
+}
+
+func TestRestoreRedacted(t *testing.T) {
+	archive, _ := snapshot(t, newTestServer(t), Redaction{Builtin: true})
+	target := etcdtest.NewServer()
+	defer target.Close()
+
+	cfg := RestoreConfig{Cluster: Cluster{Machines: target.Machines()}}
+	if _, err := Restore(context.Background(), cfg, bytes.NewReader(archive)); err != ErrRedacted {
+		t.Errorf("err = %v, want ErrRedacted", err)
+	}
+	if keys := target.Keys("/"); len(keys) != 0 {
+		t.Errorf("restored %v", keys)
+	}
+
+	cfg.AllowRedacted = true
+	if _, err := Restore(context.Background(), cfg, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := target.Get("/apps/web/password"); value != DefaultRedactMarker {
+		t.Errorf("password restored as %q, want the marker", value)
+	}
+}
+
+func TestPlanRestore(t *testing.T) {
+	archive, _ := snapshot(t, newTestServer(t), Redaction{})
+	target := etcdtest.NewServer()
+	defer target.Close()
+	target.Set("/apps/web/config", `{"port": 9090}`, 0)
+
+	cfg := RestoreConfig{Cluster: Cluster{Machines: target.Machines()}, Mode: ModeOverwriteIfUnchanged}
+	plan, err := PlanRestore(context.Background(), cfg, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.EtcdIndex != target.Index() {
+		t.Errorf("planned at index %d, want %d", plan.EtcdIndex, target.Index())
+	}
+	actions := map[string]string{}
+	for _, step := range plan.Steps {
+		actions[step.Key] = step.Action
+	}
+	want := map[string]string{
+		"/apps/web/config":   ActionUpdate,
+		"/apps/web/password": ActionCreate,
+		"/apps/db/config":    ActionCreate,
+		"/top":               ActionCreate,
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("planned %v, want %v", actions, want)
+	}
+	if keys := target.Keys("/"); len(keys) != 1 {
+		t.Errorf("planning wrote %v", keys)
+	}
+
+	// A plan survives being saved.
+	var saved bytes.Buffer
+	if err := plan.WriteJSON(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err = ReadPlan(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ApplyPlan(context.Background(), cfg, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Counts[ResultCreated] != 3 || report.Counts[ResultUpdated] != 1 {
+		t.Errorf("counts = %v, want 3 created and 1 updated", report.Counts)
+	}
+	if value, _ := target.Get("/apps/web/config"); value != `{"port": 8080}` {
+		t.Errorf("/apps/web/config = %q, want the archived value", value)
+	}
+}
+
+func TestApplyPlanChanged(t *testing.T) {
+	archive, _ := snapshot(t, newTestServer(t), Redaction{})
+	target := etcdtest.NewServer()
+	defer target.Close()
+	target.Set("/apps/web/config", `{"port": 9090}`, 0)
+
+	cfg := RestoreConfig{Cluster: Cluster{Machines: target.Machines()}}
+	plan, err := PlanRestore(context.Background(), cfg, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Set("/apps/web/config", `{"port": 7070}`, 0)
+	target.Set("/top", "created meanwhile", 0)
+
+	_, err = ApplyPlan(context.Background(), cfg, plan)
+	if err == nil || !strings.Contains(err.Error(), "/apps/web/config, /top") {
+		t.Errorf("err = %v, want the changed keys refused", err)
+	}
+	if value, _ := target.Get("/apps/web/config"); value != `{"port": 7070}` {
+		t.Errorf("/apps/web/config = %q, want it left alone", value)
+	}
+}
+
+func TestApplyPlanWrittenBelowDeleted(t *testing.T) {
+	archive, _ := snapshot(t, newTestServer(t), Redaction{})
+	target := etcdtest.NewServer()
+	defer target.Close()
+	target.Set("/old/config", "stale", 0)
+
+	cfg := RestoreConfig{Cluster: Cluster{Machines: target.Machines()}, Mode: ModeReplace}
+	plan, err := PlanRestore(context.Background(), cfg, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leaves the directory's own index alone.
+	target.Set("/old/new", "written meanwhile", 0)
+
+	_, err = ApplyPlan(context.Background(), cfg, plan)
+	if err == nil || !strings.Contains(err.Error(), "/old/new") {
+		t.Errorf("err = %v, want the key written below /old refused", err)
+	}
+	if _, ok := target.Get("/old/new"); !ok {
+		t.Error("/old/new deleted")
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"time"
+)
+
+// Verify reads the whole archive from r, and checks that it is intact: that
+// the gzip and tar streams are sound, that no entry would escape the
+// directory the archive is extracted to, and that the keys are those the
+// manifest counted and digested. Archives written by older versions have
+// no count or digest to check.
+func Verify(ctx context.Context, r io.Reader) (Manifest, error) {
+	root, m, err := ReadArchive(r)
+	if err != nil {
+		return m, err
+	}
+	if err := ctx.Err(); err != nil {
+		return m, err
+	}
+
+	if m.Digest == "" {
+		return m, nil
+	}
+	if keys := CountKeys(root); keys != m.Keys {
+		return m, fmt.Errorf("the archive holds %d keys, its manifest %d", keys, m.Keys)
+	}
+	if digest := ContentHash(root, nil); digest != m.Digest {
+		return m, fmt.Errorf("the archive has digest %s, its manifest %s", digest, m.Digest)
+	}
+	return m, nil
+}
+
+// Entry is a key of an archive.
+type Entry struct {
+	Key           string     `json:"key"`
+	Dir           bool       `json:"dir,omitempty"`
+	Size          int        `json:"size"`
+	Expiration    *time.Time `json:"expiration,omitempty"`
+	ModifiedIndex uint64     `json:"modifiedIndex"`
+	CreatedIndex  uint64     `json:"createdIndex"`
+}
+
+// List returns the keys of the archive read from r, sorted, along with its
+// manifest.
+func List(ctx context.Context, r io.Reader) ([]Entry, Manifest, error) {
+	root, m, err := ReadArchive(r)
+	if err != nil {
+		return nil, m, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, m, err
+	}
+
+	var entries []Entry
+	var walk func(node *etcd.Node)
+	walk = func(node *etcd.Node) {
+		if len(node.Key) > 0 {
+			entries = append(entries, Entry{
+				Key:           node.Key,
+				Dir:           node.Dir,
+				Size:          len(node.Value),
+				Expiration:    node.Expiration,
+				ModifiedIndex: node.ModifiedIndex,
+				CreatedIndex:  node.CreatedIndex,
+			})
+		}
+		for _, subNode := range sortedNodes(node.Nodes) {
+			walk(subNode)
+		}
+	}
+	walk(root)
+	return entries, m, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/vaughan0/go-ini"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A configuration file sets the defaults of options, so that the command
+// line overrides the environment, which overrides the file, and the
+// environment of commands run by etcdbk doesn't carry its values.
+//
+// Options at the top of the file apply to every command, and those of a
+// section such as [s3] or [s3.continuous] to that command only. A
+// [cluster "NAME"] section, selected by --profile, applies to any command,
+// over the others.
+type configFile struct {
+	file    ini.File
+	profile ini.Section
+
+	// profiles holds every [cluster "NAME"] section by name.
+	profiles map[string]ini.Section
+}
+
+var profileSection = regexp.MustCompile(`^cluster\s+"([^"]*)"$`)
+
+// Options whose values are kept out of `config show`.
+var secretOptions = regexp.MustCompile(`secret|token|password|salt|webhook|slack`)
+
+// builtinDefaults holds the defaults of the options the configuration file
+// replaced, so that it can be applied again.
+var builtinDefaults = map[*flags.Option][]string{}
+
+type Config struct{}
+
+type ConfigShow struct{}
+
+var (
+	config     Config
+	configShow ConfigShow
+)
+
+// loadConfig reads the configuration file at path, checking that every
+// section and option in it exists.
+func loadConfig(path, profile string) (*configFile, error) {
+	file, err := ini.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &configFile{file: file, profiles: map[string]ini.Section{}}
+
+	for name, section := range file {
+		if m := profileSection.FindStringSubmatch(name); m != nil {
+			if _, ok := c.profiles[m[1]]; ok {
+				return nil, fmt.Errorf("%s: duplicate [cluster %q] section", path, m[1])
+			}
+			c.profiles[m[1]] = section
+			if m[1] == profile {
+				c.profile = section
+			}
+			for key := range section {
+				if len(findOptions(parser.Command, key, true)) == 0 {
+					return nil, fmt.Errorf("%s: unknown option %q in [%s]", path, key, name)
+				}
+			}
+			continue
+		}
+
+		cmd := commandBySection(name)
+		if cmd == nil {
+			return nil, fmt.Errorf("%s: unknown section [%s]", path, name)
+		}
+		for key := range section {
+			if len(findOptions(cmd, key, false)) == 0 {
+				return nil, fmt.Errorf("%s: unknown option %q in [%s]", path, key, name)
+			}
+		}
+	}
+
+	if profile != "" && c.profile == nil {
+		return nil, fmt.Errorf("%s: no [cluster %q] section for --profile", path, profile)
+	}
+	return c, nil
+}
+
+// values returns what the file sets the options of the commands along path
+// to.
+func (c *configFile) values(path []*flags.Command) map[*flags.Option]string {
+	values := map[*flags.Option]string{}
+	for i, cmd := range path {
+		for key, value := range c.file[sectionName(path[1:i+1])] {
+			for _, option := range findOptions(cmd, key, false) {
+				values[option] = value
+			}
+		}
+	}
+
+	for key, value := range c.profile {
+		for _, cmd := range path {
+			for _, option := range findOptions(cmd, key, false) {
+				values[option] = value
+			}
+		}
+	}
+	return values
+}
+
+// applyConfig makes the --config file values the defaults of the options of
+// the command args run, in place of those of a previous call.
+func applyConfig(args []string) error {
+	for option, defaults := range builtinDefaults {
+		option.Default = defaults
+	}
+	builtinDefaults = map[*flags.Option][]string{}
+
+	path, given := scanArgs(args)
+	c, err := configFor(given)
+	if c == nil || err != nil {
+		return err
+	}
+
+	for option, value := range c.values(path) {
+		if option.EnvDefaultKey == "" {
+			return fmt.Errorf("--%s can only be set on the command line", option.LongName)
+		}
+		defaults, err := fileDefault(option, value)
+		if err != nil {
+			return err
+		}
+		builtinDefaults[option] = option.Default
+		option.Default = defaults
+	}
+	return nil
+}
+
+// fileDefault turns an option set to value in the configuration file into
+// its default, split like its environment variable would be. go-flags
+// ignores defaults it can't convert, and options taking a function parse
+// durations and exit on errors, so values are checked here.
+func fileDefault(option *flags.Option, value string) ([]string, error) {
+	defaults := []string{value}
+	if option.EnvDefaultDelim != "" {
+		defaults = strings.Split(value, option.EnvDefaultDelim)
+	}
+
+	for _, d := range defaults {
+		var err error
+		switch reflect.TypeOf(option.Value()).Kind() {
+		case reflect.Bool:
+			_, err = strconv.ParseBool(d)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			_, err = strconv.ParseInt(d, 10, 64)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			_, err = strconv.ParseUint(d, 10, 64)
+		case reflect.Func:
+			if takesArgument(option) {
+				_, err = time.ParseDuration(d)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for --%s", d, option.LongName)
+		}
+	}
+	return defaults, nil
+}
+
+// configFor loads the configuration file named on the command line, or
+// else in the environment, nil if there is none.
+func configFor(given map[*flags.Option][]string) (*configFile, error) {
+	path, profile := os.Getenv("CONFIG_FILE"), os.Getenv("CONFIG_PROFILE")
+	for option, values := range given {
+		switch option.LongName {
+		case "config":
+			path = values[len(values)-1]
+		case "profile":
+			profile = values[len(values)-1]
+		}
+	}
+
+	if path == "" {
+		if profile != "" {
+			return nil, fmt.Errorf("--profile requires --config")
+		}
+		return nil, nil
+	}
+	return loadConfig(path, profile)
+}
+
+// scanArgs finds the command args run, and the options given for it,
+// ahead of parsing them.
+func scanArgs(args []string) ([]*flags.Command, map[*flags.Option][]string) {
+	path := []*flags.Command{parser.Command}
+	given := map[*flags.Option][]string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		var option *flags.Option
+		var value string
+		hasValue := false
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name := strings.TrimPrefix(arg, "--")
+			if j := strings.Index(name, "="); j >= 0 {
+				name, value, hasValue = name[:j], name[j+1:], true
+			}
+			option = pathOption(path, func(o *flags.Option) bool { return o.LongName == name })
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			short := []rune(arg[1:])[0]
+			if rest := arg[1+len(string(short)):]; rest != "" {
+				value, hasValue = strings.TrimPrefix(rest, "="), true
+			}
+			option = pathOption(path, func(o *flags.Option) bool { return o.ShortName == short })
+		default:
+			if cmd := path[len(path)-1].Find(arg); cmd != nil {
+				path = append(path, cmd)
+			}
+			continue
+		}
+
+		if option == nil {
+			continue
+		}
+		if !hasValue && takesArgument(option) && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		given[option] = append(given[option], value)
+	}
+	return path, given
+}
+
+// pathOption returns the first option of the commands along path that
+// matches.
+func pathOption(path []*flags.Command, match func(*flags.Option) bool) *flags.Option {
+	for i := len(path) - 1; i >= 0; i-- {
+		for _, option := range commandOptions(path[i], false) {
+			if match(option) {
+				return option
+			}
+		}
+	}
+	return nil
+}
+
+func takesArgument(option *flags.Option) bool {
+	t := reflect.TypeOf(option.Value())
+	switch {
+	case t.Kind() == reflect.Bool:
+		return false
+	case t.Kind() == reflect.Func:
+		return t.NumIn() > 0
+	}
+	return true
+}
+
+// commandOptions returns the options of cmd, and with sub of its
+// subcommands.
+func commandOptions(cmd *flags.Command, sub bool) []*flags.Option {
+	options := cmd.Options()
+	var walk func(groups []*flags.Group)
+	walk = func(groups []*flags.Group) {
+		for _, g := range groups {
+			options = append(options, g.Options()...)
+			walk(g.Groups())
+		}
+	}
+	walk(cmd.Groups())
+
+	if sub {
+		for _, subCmd := range cmd.Commands() {
+			options = append(options, commandOptions(subCmd, true)...)
+		}
+	}
+	return options
+}
+
+// findOptions returns the options of cmd named key, and with sub those of
+// its subcommands.
+func findOptions(cmd *flags.Command, key string, sub bool) []*flags.Option {
+	var found []*flags.Option
+	for _, option := range commandOptions(cmd, sub) {
+		if option.LongName == key {
+			found = append(found, option)
+		}
+	}
+	return found
+}
+
+// commandBySection returns the command of a section such as s3.continuous,
+// the top-level one for the options at the top of the file.
+func commandBySection(name string) *flags.Command {
+	cmd := parser.Command
+	if name == "" {
+		return cmd
+	}
+	for _, part := range strings.Split(name, ".") {
+		if cmd = cmd.Find(part); cmd == nil {
+			return nil
+		}
+	}
+	return cmd
+}
+
+func sectionName(path []*flags.Command) string {
+	var names []string
+	for _, cmd := range path {
+		names = append(names, cmd.Name)
+	}
+	return strings.Join(names, ".")
+}
+
+// Execute prints the options of every command as a configuration file, as
+// the command line, the environment, the --config file and the defaults
+// set them.
+func (o *ConfigShow) Execute(args []string) error {
+	_, given := scanArgs(os.Args[1:])
+	c, err := configFor(given)
+	if err != nil {
+		return err
+	}
+
+	var show func(path []*flags.Command)
+	show = func(path []*flags.Command) {
+		cmd := path[len(path)-1]
+		if len(path) == 2 && cmd.Name == "config" {
+			return
+		}
+
+		var file map[*flags.Option]string
+		if c != nil {
+			file = c.values(path)
+		}
+
+		var lines []string
+		for _, option := range commandOptions(cmd, false) {
+			if option.LongName == "" || option.LongName == "help" {
+				continue
+			}
+			value, ok := optionValue(option, given, file)
+			if !ok {
+				continue
+			}
+			if secretOptions.MatchString(option.LongName) && value != "" {
+				value = "REDACTED"
+			}
+			lines = append(lines, fmt.Sprintf("%s = %s", option.LongName, value))
+		}
+		sort.Strings(lines)
+
+		if len(lines) > 0 {
+			if len(path) > 1 {
+				fmt.Printf("\n[%s]\n", sectionName(path[1:]))
+			}
+			for _, line := range lines {
+				fmt.Println(line)
+			}
+		}
+
+		for _, subCmd := range cmd.Commands() {
+			show(append(path[:len(path):len(path)], subCmd))
+		}
+	}
+	show([]*flags.Command{parser.Command})
+	return nil
+}
+
+// optionValue returns the value of option as given on the command line, in
+// the environment, in the configuration file, or by default.
+func optionValue(option *flags.Option, given map[*flags.Option][]string, file map[*flags.Option]string) (string, bool) {
+	if values, ok := given[option]; ok {
+		if !takesArgument(option) {
+			return "true", true
+		}
+		return strings.Join(values, delimiter(option)), true
+	}
+	if key := option.EnvDefaultKey; key != "" {
+		if value, ok := os.LookupEnv(key); ok {
+			return value, true
+		}
+	}
+	if value, ok := file[option]; ok {
+		return value, true
+	}
+	if len(option.Default) > 0 {
+		return strings.Join(option.Default, delimiter(option)), true
+	}
+	return "", false
+}
+
+func delimiter(option *flags.Option) string {
+	if option.EnvDefaultDelim != "" {
+		return option.EnvDefaultDelim
+	}
+	return ","
+}
+
+func init() {
+	configCmd, _ := parser.AddCommand("config",
+		"Show configuration",
+		"Commands about the --config file.",
+		&config,
+	)
+	configCmd.AddCommand("show",
+		"Show effective configuration",
+		"Print the options of every command as a configuration file, with the values the command line, the environment, the --config file and the defaults give them. Secrets are redacted.",
+		&configShow,
+	)
+}
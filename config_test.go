@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a configuration file for the test, and returns its
+// path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "etcdbk.ini")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// unsetenv unsets key for the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	if value, ok := os.LookupEnv(key); ok {
+		os.Unsetenv(key)
+		t.Cleanup(func() { os.Setenv(key, value) })
+	}
+}
+
+const testConfig = `
+etcd-hosts = http://etcd-1:2379,http://etcd-2:2379
+
+[s3]
+aws-bucket = etcdbackups
+aws-secret = file-secret
+notify-retries = 5
+
+[cluster "prod"]
+aws-secret = prod-secret
+
+[cluster "staging"]
+cluster-name = stg
+s3-virtual-host = true
+`
+
+func TestApplyConfig(t *testing.T) {
+	for _, key := range []string{"AWS_SECRET_ACCESS_KEY", "AWS_S3_BUCKET", "ETCD_HOSTS", "NOTIFY_RETRIES"} {
+		unsetenv(t, key)
+	}
+	path := writeConfig(t, testConfig)
+	defaults := func(section, key string) []string {
+		return findOptions(commandBySection(section), key, false)[0].Default
+	}
+	builtin := defaults("s3", "aws-bucket")
+
+	if err := applyConfig([]string{"--config", path, "s3", "continuous"}); err != nil {
+		t.Fatal(err)
+	}
+	defer applyConfig(nil)
+	if got, want := defaults("", "etcd-hosts"), []string{"http://etcd-1:2379", "http://etcd-2:2379"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("etcd-hosts defaults to %q, want %q", got, want)
+	}
+	if got := defaults("s3", "aws-secret"); !reflect.DeepEqual(got, []string{"file-secret"}) {
+		t.Errorf("aws-secret defaults to %q, want file-secret", got)
+	}
+	// Commands run by etcdbk don't inherit the file.
+	for _, key := range []string{"AWS_SECRET_ACCESS_KEY", "AWS_S3_BUCKET", "ETCD_HOSTS"} {
+		if value, ok := os.LookupEnv(key); ok {
+			t.Errorf("$%s set to %q", key, value)
+		}
+	}
+
+	// The profile goes over the sections.
+	if err := applyConfig([]string{"--config=" + path, "--profile", "prod", "s3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaults("s3", "aws-secret"); !reflect.DeepEqual(got, []string{"prod-secret"}) {
+		t.Errorf("aws-secret defaults to %q, want prod-secret", got)
+	}
+
+	// Without a file, the built-in defaults are back.
+	if err := applyConfig([]string{"s3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaults("s3", "aws-bucket"); !reflect.DeepEqual(got, builtin) {
+		t.Errorf("aws-bucket defaults to %q, want %q", got, builtin)
+	}
+	if got := defaults("s3", "notify-retries"); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("notify-retries defaults to %q, want 3", got)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	defer applyConfig(nil)
+	for name, content := range map[string]string{
+		"unknown section":   "[s4]\naws-bucket = etcdbackups\n",
+		"unknown option":    "[s3]\naws-bukket = etcdbackups\n",
+		"command line only": "[s3]\nforce = true\n",
+		"invalid number":    "[s3]\nnotify-retries = many\n",
+		"invalid boolean":   "[s3]\ns3-virtual-host = sure\n",
+		"invalid duration":  "[s3.continuous]\nmin-period = 5 minutes\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := applyConfig([]string{"--config", writeConfig(t, content), "s3", "continuous"}); err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestClusterOptions(t *testing.T) {
+	for _, key := range []string{"AWS_SECRET_ACCESS_KEY", "AWS_S3_BUCKET", "AWS_S3_VIRTUAL_HOST", "ETCD_HOSTS", "NOTIFY_RETRIES"} {
+		unsetenv(t, key)
+	}
+	c, err := loadConfig(writeConfig(t, testConfig), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prod, err := c.clusterOptions("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, err := c.clusterOptions("staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prod.S3.ClusterName != "prod" || prod.S3.AwsSecretKey != "prod-secret" || prod.S3.AwsVirtualHost {
+		t.Errorf("prod options = %+v", prod.S3.S3Location)
+	}
+	if staging.S3.ClusterName != "stg" || staging.S3.AwsSecretKey != "file-secret" || !staging.S3.AwsVirtualHost {
+		t.Errorf("staging options = %+v", staging.S3.S3Location)
+	}
+	for _, co := range []*clusterOptions{prod, staging} {
+		if co.S3.AwsBucket != "etcdbackups" || co.S3.NotifyRetries != 5 || len(co.EtcdMachines) != 2 {
+			t.Errorf("%s: shared options not applied: %+v", co.S3.ClusterName, co)
+		}
+	}
+
+	// The environment overrides the file, but not the cluster name.
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("CLUSTER_NAME", "env-name")
+	if prod, err = c.clusterOptions("prod"); err != nil {
+		t.Fatal(err)
+	}
+	if prod.S3.ClusterName != "prod" || prod.S3.AwsSecretKey != "env-secret" {
+		t.Errorf("prod options = %+v", prod.S3.S3Location)
+	}
+
+	c, err = loadConfig(writeConfig(t, "[cluster \"prod\"]\nnotify-retries = many\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.clusterOptions("prod"); err == nil {
+		t.Error("invalid number accepted")
+	}
+}
+
+func TestContinuousOptions(t *testing.T) {
+	for _, key := range []string{"AWS_SECRET_ACCESS_KEY", "AWS_S3_BUCKET", "ETCD_HOSTS", "MIN_PERIOD", "NOTIFY_RETRIES"} {
+		unsetenv(t, key)
+	}
+	path := writeConfig(t, testConfig+"\n[s3.continuous]\nmin-period = 10m\nmax-period = 2h\n")
+
+	co, err := continuousOptions([]string{"--config", path, "--metrics-addr=:9102", "s3", "--aws-bucket", "cli-bucket", "continuous", "--min-period=5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.S3.AwsBucket != "cli-bucket" || co.Interval.MinPeriodDuration != 5*time.Minute {
+		t.Errorf("command line not applied: bucket %q, min period %s", co.S3.AwsBucket, co.Interval.MinPeriodDuration)
+	}
+	if co.S3.AwsSecretKey != "file-secret" || co.S3.NotifyRetries != 5 || co.Interval.MaxPeriodDuration != 2*time.Hour {
+		t.Errorf("config file not applied: %+v", co)
+	}
+	if co.S3.ClusterName != "etcd-cluster" || co.Interval.LockTTLDuration != 30*time.Second {
+		t.Errorf("defaults not applied: %+v", co)
+	}
+}
+
+func TestDaemonSharedStatus(t *testing.T) {
+	for _, key := range []string{"STATUS_FILE", "STATUS_KEY", "ETCD_HOSTS"} {
+		unsetenv(t, key)
+	}
+	for name, content := range map[string]string{
+		"file": "status-file = /var/lib/etcdbk/status.json\n[cluster \"a\"]\n[cluster \"b\"]\n",
+		"key":  "[cluster \"a\"]\nstatus-key = /_etcdbk/status\n[cluster \"b\"]\nstatus-key = _etcdbk/status\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", writeConfig(t, content))
+			err := (&Daemon{}).Execute(nil)
+			if err == nil || !strings.Contains(err.Error(), `clusters "a" and "b" share`) {
+				t.Errorf("err = %v, want clusters sharing a status refused", err)
+			}
+		})
+	}
+}
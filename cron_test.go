@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"*/15 * * * *", "2016-02-11T10:07:30Z", "2016-02-11T10:15:00Z"},
+		{"*/15 * * * *", "2016-02-11T10:45:00Z", "2016-02-11T11:00:00Z"},
+		// Strictly after.
+		{"@hourly", "2016-02-11T10:00:00Z", "2016-02-11T11:00:00Z"},
+		{"@daily", "2016-02-11T18:04:05Z", "2016-02-12T00:00:00Z"},
+		{"@midnight", "2016-12-31T23:59:59Z", "2017-01-01T00:00:00Z"},
+		{"@weekly", "2016-02-11T18:04:05Z", "2016-02-14T00:00:00Z"},
+		{"@monthly", "2016-02-11T18:04:05Z", "2016-03-01T00:00:00Z"},
+		{"@yearly", "2016-02-11T18:04:05Z", "2017-01-01T00:00:00Z"},
+		// Thursday to the next weekday.
+		{"30 2 * * 1-5", "2016-02-11T03:00:00Z", "2016-02-12T02:30:00Z"},
+		// Friday to Monday.
+		{"30 2 * * 1-5", "2016-02-12T03:00:00Z", "2016-02-15T02:30:00Z"},
+		// Sunday is 7 as well as 0.
+		{"0 0 * * 7", "2016-02-11T00:00:00Z", "2016-02-14T00:00:00Z"},
+		{"0 0 * * 0", "2016-02-11T00:00:00Z", "2016-02-14T00:00:00Z"},
+		// With both day fields restricted, either matches: the 13th, or
+		// any Friday.
+		{"0 0 13 * 5", "2016-02-06T00:00:00Z", "2016-02-12T00:00:00Z"},
+		{"0 0 13 * 5", "2016-02-12T00:00:00Z", "2016-02-13T00:00:00Z"},
+		{"0 0 13 * 5", "2016-02-13T00:00:00Z", "2016-02-19T00:00:00Z"},
+		// With one of them *, only the other one counts.
+		{"0 0 13 * *", "2016-02-06T00:00:00Z", "2016-02-13T00:00:00Z"},
+		{"0 0 * * 5", "2016-02-06T00:00:00Z", "2016-02-12T00:00:00Z"},
+		{"30 6 1 */3 *", "2016-02-11T00:00:00Z", "2016-04-01T06:30:00Z"},
+		{"0,30 9-17/4 * * *", "2016-02-11T13:45:00Z", "2016-02-11T17:00:00Z"},
+		{"0 0 29 2 *", "2016-03-01T00:00:00Z", "2020-02-29T00:00:00Z"},
+		// Never.
+		{"0 0 31 2 *", "2016-02-11T00:00:00Z", ""},
+		// Evaluated in UTC.
+		{"0 12 * * *", "2016-02-11T12:30:00+02:00", "2016-02-11T12:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr+" from "+tt.from, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, err := time.Parse(time.RFC3339, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := s.Next(from)
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next = %s, want none", got)
+				}
+				return
+			}
+			if want, _ := time.Parse(time.RFC3339, tt.want); !got.Equal(want) {
+				t.Errorf("Next = %s, want %s", got.Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@fortnightly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted it", expr)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Daemon struct {
+	Clusters []string `long:"cluster" env:"DAEMON_CLUSTERS" env-delim:"," description:"Only back up this cluster of the --config file; may be repeated"`
+}
+
+var daemon Daemon
+
+// clusterOptions are what every [cluster "NAME"] section of the daemon's
+// configuration file may set: the options of `s3 continuous`, and those of
+// the top level that concern a single cluster.
+type clusterOptions struct {
+	EtcdMachines []string `long:"etcd-hosts" short:"e" default:"http://127.0.0.1:4001" env:"ETCD_HOSTS" env-delim:"," description:"etcd machines"`
+	StatusKey    string   `long:"status-key" env:"STATUS_KEY" description:"etcd key recording the last successful backup, e.g. /_etcdbk/status"`
+	StatusFile   string   `long:"status-file" env:"STATUS_FILE" description:"Local file recording the last successful backup"`
+
+	S3       ToS3         `group:"S3 Options"`
+	Interval S3OnInterval `group:"Continuous Options"`
+}
+
+func (o *Daemon) Execute(args []string) error {
+	_, given := scanArgs(os.Args[1:])
+	c, err := configFor(given)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("the daemon requires --config")
+	}
+
+	names := o.Clusters
+	if len(names) == 0 {
+		for name := range c.profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no [cluster \"NAME\"] section in the --config file")
+	}
+
+	var jobs []*backupJob
+	var timeout time.Duration
+	// Clusters sharing a status would overwrite each other's.
+	statuses := map[string]string{}
+	for _, name := range names {
+		co, err := c.clusterOptions(name)
+		if err != nil {
+			return fmt.Errorf("cluster %q: %v", name, err)
+		}
+		for _, status := range co.statuses() {
+			if other, ok := statuses[status]; ok {
+				return fmt.Errorf("clusters %q and %q share the %s", other, name, status)
+			}
+			statuses[status] = name
+		}
+
+		status := statusStore{machines: co.EtcdMachines, key: co.StatusKey, file: co.StatusFile}
+		j := newBackupJob(name, co.EtcdMachines, &co.S3, &co.Interval, status)
+		if err := j.check(); err != nil {
+			return fmt.Errorf("cluster %q: %v", name, err)
+		}
+		j.options = reloadCluster(given, name)
+		jobs = append(jobs, j)
+
+		if co.Interval.ShutdownDuration > timeout {
+			timeout = co.Interval.ShutdownDuration
+		}
+	}
+
+	metrics.Set("clusters", clusterMetrics)
+	serveMetrics(opts.MetricsAddr)
+	return runJobs(jobs, timeout)
+}
+
+// statuses describes where the cluster records its status.
+func (co *clusterOptions) statuses() []string {
+	var statuses []string
+	if co.StatusFile != "" {
+		file := co.StatusFile
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		statuses = append(statuses, "status file "+file)
+	}
+	if co.StatusKey != "" {
+		machines := append([]string(nil), co.EtcdMachines...)
+		sort.Strings(machines)
+		statuses = append(statuses, fmt.Sprintf("status key %s of %s", path.Join("/", co.StatusKey), strings.Join(machines, ",")))
+	}
+	return statuses
+}
+
+// reloadCluster reads the options of the cluster name from the --config
+// file again.
+func reloadCluster(given map[*flags.Option][]string, name string) func() (*clusterOptions, error) {
+	return func() (*clusterOptions, error) {
+		c, err := configFor(given)
+		if err != nil {
+			return nil, err
+		}
+		return c.clusterOptions(name)
+	}
+}
+
+// clusterOptions parses the options of the cluster name: its section over
+// the [s3.continuous], [s3] and top-level ones, all under the environment.
+// Archives are named after the section unless it sets cluster-name, which
+// is the one option the environment doesn't override.
+func (c *configFile) clusterOptions(name string) (*clusterOptions, error) {
+	section, ok := c.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no [cluster %q] section in the --config file", name)
+	}
+
+	_, _, options := newClusterParser()
+	for key := range section {
+		if options[key] == nil {
+			return nil, fmt.Errorf("--%s applies to every cluster, and cannot be set in [cluster %q]", key, name)
+		}
+	}
+
+	file := *c
+	file.profile = section
+	values := map[string]string{}
+	for option, value := range file.values(continuousPath()) {
+		values[option.LongName] = value
+	}
+	if _, ok := section["cluster-name"]; !ok {
+		values["cluster-name"] = name
+	}
+
+	// The name must tell clusters apart, so the environment can't override
+	// it.
+	given := map[string][]string{"cluster-name": {values["cluster-name"]}}
+	delete(values, "cluster-name")
+	return parseClusterOptions(values, given)
+}
+
+// continuousOptions parses the options of `s3 continuous` as the command
+// line args and the --config file give them, e.g. to read the file again.
+func continuousOptions(args []string) (*clusterOptions, error) {
+	path, scanned := scanArgs(args)
+	c, err := configFor(scanned)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	if c != nil {
+		for option, value := range c.values(path) {
+			values[option.LongName] = value
+		}
+	}
+	given := map[string][]string{}
+	for option, v := range scanned {
+		given[option.LongName] = v
+	}
+	return parseClusterOptions(values, given)
+}
+
+// continuousPath is the path of commands to `s3 continuous`.
+func continuousPath() []*flags.Command {
+	return []*flags.Command{parser.Command, commandBySection("s3"), commandBySection("s3.continuous")}
+}
+
+// newClusterParser returns clusterOptions, their parser, and their options
+// by name.
+func newClusterParser() (*clusterOptions, *flags.Parser, map[string]*flags.Option) {
+	co := new(clusterOptions)
+	co.Interval.bindDurations()
+	p := flags.NewParser(co, flags.None)
+	options := map[string]*flags.Option{}
+	for _, option := range commandOptions(p.Command, false) {
+		options[option.LongName] = option
+	}
+	return co, p, options
+}
+
+// parseClusterOptions parses clusterOptions from the configuration file
+// values and the command-line values given, both by option name. Other
+// options, which apply to the whole process such as --metrics-addr, are
+// ignored.
+func parseClusterOptions(values map[string]string, given map[string][]string) (*clusterOptions, error) {
+	co, p, options := newClusterParser()
+	for key, value := range values {
+		option := options[key]
+		if option == nil {
+			continue
+		}
+		defaults, err := fileDefault(option, value)
+		if err != nil {
+			return nil, err
+		}
+		option.Default = defaults
+	}
+
+	var args []string
+	for key, values := range given {
+		option := options[key]
+		if option == nil {
+			continue
+		}
+		for _, value := range values {
+			if takesArgument(option) {
+				args = append(args, "--"+key+"="+value)
+			} else {
+				args = append(args, "--"+key)
+			}
+		}
+	}
+
+	rest, err := p.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", rest)
+	}
+	return co, nil
+}
+
+func init() {
+	parser.AddCommand("daemon",
+		"Backup several clusters to S3 continuously",
+		"Backup every [cluster \"NAME\"] section of the --config file to S3, like `s3 continuous` would, each on its own schedule.",
+		&daemon,
+	)
+}
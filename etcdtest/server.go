@@ -0,0 +1,754 @@
+// Package etcdtest serves an in-memory etcd v2 keys API over httptest, for
+// tests that need a cluster without running etcd:
+//
+//	srv := etcdtest.NewServer()
+//	defer srv.Close()
+//	srv.Set("/app/config", "value", 0)
+//	client := etcd.NewClient(srv.Machines())
+//
+// It supports recursive and sorted GETs, PUTs with TTLs, creates,
+// compare-and-swaps and TTL refreshes, recursive and compare-and-delete
+// DELETEs, in-order key POSTs, and watches from an index, with the
+// X-Etcd-Index header on every response. Like etcd, it only remembers the last HistorySize events, and
+// answers watches from before them with error 401. Together with the goamz
+// s3test server, it lets backups be taken, uploaded and restored end to
+// end with no external service.
+package etcdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcd v2 API error codes.
+const (
+	ErrKeyNotFound     = 100
+	ErrTestFailed      = 101
+	ErrNotFile         = 102
+	ErrNotDir          = 104
+	ErrNodeExist       = 105
+	ErrRootReadOnly    = 107
+	ErrDirNotEmpty     = 108
+	ErrEventIndexClear = 401
+	ErrInvalidField    = 209
+	ErrRefreshValue    = 211
+	ErrRefreshTTL      = 212
+)
+
+var errorMessages = map[int]string{
+	ErrKeyNotFound:     "Key not found",
+	ErrTestFailed:      "Compare failed",
+	ErrNotFile:         "Not a file",
+	ErrNotDir:          "Not a directory",
+	ErrNodeExist:       "Key already exists",
+	ErrRootReadOnly:    "Root is read only",
+	ErrDirNotEmpty:     "Directory not empty",
+	ErrEventIndexClear: "The event in requested index is outdated and cleared",
+	ErrInvalidField:    "Invalid field",
+	ErrRefreshValue:    "Value provided on refresh",
+	ErrRefreshTTL:      "A TTL must be provided on refresh",
+}
+
+var errorStatus = map[int]int{
+	ErrKeyNotFound:     http.StatusNotFound,
+	ErrTestFailed:      http.StatusPreconditionFailed,
+	ErrNotFile:         http.StatusForbidden,
+	ErrNotDir:          http.StatusForbidden,
+	ErrNodeExist:       http.StatusPreconditionFailed,
+	ErrRootReadOnly:    http.StatusForbidden,
+	ErrDirNotEmpty:     http.StatusForbidden,
+	ErrEventIndexClear: http.StatusBadRequest,
+	ErrInvalidField:    http.StatusBadRequest,
+	ErrRefreshValue:    http.StatusBadRequest,
+	ErrRefreshTTL:      http.StatusBadRequest,
+}
+
+// Node is the JSON representation of a key.
+type Node struct {
+	Key           string     `json:"key,omitempty"`
+	Value         *string    `json:"value,omitempty"`
+	Dir           bool       `json:"dir,omitempty"`
+	Expiration    *time.Time `json:"expiration,omitempty"`
+	TTL           int64      `json:"ttl,omitempty"`
+	Nodes         []*Node    `json:"nodes,omitempty"`
+	ModifiedIndex uint64     `json:"modifiedIndex,omitempty"`
+	CreatedIndex  uint64     `json:"createdIndex,omitempty"`
+}
+
+type response struct {
+	Action   string `json:"action"`
+	Node     *Node  `json:"node"`
+	PrevNode *Node  `json:"prevNode,omitempty"`
+}
+
+type etcdError struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+	Index     uint64 `json:"index"`
+}
+
+func (e *etcdError) Error() string {
+	return fmt.Sprintf("%d: %s (%s) [%d]", e.ErrorCode, e.Message, e.Cause, e.Index)
+}
+
+// Server is a single-member etcd v2 cluster, keeping every key in memory.
+type Server struct {
+	*httptest.Server
+
+	// Version is reported by /version.
+	Version string
+	// Name is the name of the member reported by /v2/members.
+	Name string
+	// HistorySize is how many events are kept for watches, 1000 like etcd
+	// by default.
+	HistorySize int
+
+	mu      sync.Mutex
+	index   uint64
+	root    *node
+	history []event
+	changed chan struct{}
+	now     func() time.Time
+	stop    chan struct{}
+}
+
+type node struct {
+	key        string
+	value      string
+	dir        bool
+	expiration *time.Time
+	children   map[string]*node
+	created    uint64
+	modified   uint64
+}
+
+type event struct {
+	response
+	index uint64
+}
+
+// NewServer starts a server with an empty keyspace. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Version:     "2.3.8",
+		Name:        "etcdtest",
+		HistorySize: 1000,
+		root:        &node{key: "/", dir: true, children: map[string]*node{}},
+		changed:     make(chan struct{}),
+		now:         time.Now,
+		stop:        make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(s)
+	go s.expireLoop()
+	return s
+}
+
+// Close shuts the server down, ending any watches.
+func (s *Server) Close() {
+	close(s.stop)
+	s.Server.CloseClientConnections()
+	s.Server.Close()
+}
+
+// Machines returns the client URLs, as given to etcd.NewClient.
+func (s *Server) Machines() []string {
+	return []string{s.URL}
+}
+
+// Index returns the current etcd index.
+func (s *Server) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+// Set stores value at key, creating parent directories, as a test fixture.
+func (s *Server) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.put(key, putOptions{value: value, ttl: ttl})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete removes key, and everything below it, as a test fixture.
+func (s *Server) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.delete(key, map[string][]string{"recursive": {"true"}})
+	return err
+}
+
+// Get returns the value at key, and whether it exists and isn't a directory.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, _, err := s.lookup(key)
+	if err != nil || n.dir {
+		return "", false
+	}
+	return n.value, true
+}
+
+// Keys returns every value below prefix, by key.
+func (s *Server) Keys(prefix string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := map[string]string{}
+	n, _, err := s.lookup(prefix)
+	if err != nil {
+		return keys
+	}
+	var walk func(*node)
+	walk = func(n *node) {
+		if !n.dir {
+			keys[n.key] = n.value
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(n)
+	return keys
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Like etcd's mux, redirect paths with dot segments to their clean form.
+	if cleaned := path.Clean(r.URL.Path); cleaned != strings.TrimSuffix(r.URL.Path, "/") && cleaned != r.URL.Path {
+		http.Redirect(w, r, cleaned, http.StatusMovedPermanently)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/version":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"etcdserver":  s.Version,
+			"etcdcluster": s.Version[:strings.LastIndex(s.Version, ".")] + ".0",
+		})
+	case r.URL.Path == "/v2/members":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"members": []map[string]interface{}{s.member()},
+		})
+	case r.URL.Path == "/v2/stats/self":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":      s.Name,
+			"id":        s.memberID(),
+			"state":     "StateLeader",
+			"startTime": time.Now().UTC(),
+			"leaderInfo": map[string]interface{}{
+				"leader": s.memberID(),
+			},
+		})
+	case r.URL.Path == "/v2/stats/leader":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"leader":    s.memberID(),
+			"followers": map[string]interface{}{},
+		})
+	case r.URL.Path == "/v2/machines":
+		fmt.Fprint(w, s.URL)
+	case strings.HasPrefix(r.URL.Path, "/v2/keys"):
+		s.serveKeys(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) memberID() string {
+	return "8e9e05c52164694d"
+}
+
+func (s *Server) member() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         s.memberID(),
+		"name":       s.Name,
+		"peerURLs":   []string{"http://localhost:2380"},
+		"clientURLs": []string{s.URL},
+	}
+}
+
+func (s *Server) serveKeys(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := path.Join("/", strings.TrimPrefix(r.URL.Path, "/v2/keys"))
+
+	if r.Method == "GET" && r.Form.Get("wait") == "true" {
+		s.serveWatch(w, r, key)
+		return
+	}
+
+	s.mu.Lock()
+	var resp *response
+	var err error
+	switch r.Method {
+	case "GET":
+		resp, err = s.get(key, r.Form.Get("recursive") == "true")
+	case "PUT":
+		var opts putOptions
+		if opts, err = parsePutOptions(r); err == nil {
+			resp, err = s.put(key, opts)
+		}
+	case "POST":
+		var opts putOptions
+		if opts, err = parsePutOptions(r); err == nil {
+			opts.prevExist = "false"
+			resp, err = s.put(path.Join(key, fmt.Sprintf("%020d", s.index+1)), opts)
+		}
+	case "DELETE":
+		resp, err = s.delete(key, r.Form)
+	default:
+		s.mu.Unlock()
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	index := s.index
+	s.mu.Unlock()
+
+	s.writeResponse(w, resp, err, index)
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, resp *response, err error, index uint64) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Raft-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Raft-Term", "1")
+
+	if etcdErr, ok := err.(*etcdError); ok {
+		writeJSON(w, errorStatus[etcdErr.ErrorCode], etcdErr)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if resp.Action == "create" || (resp.Action == "set" && resp.PrevNode == nil) {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) newError(code int, cause string) *etcdError {
+	return &etcdError{
+		ErrorCode: code,
+		Message:   errorMessages[code],
+		Cause:     cause,
+		Index:     s.index,
+	}
+}
+
+// lookup returns the node at key and its parent.
+func (s *Server) lookup(key string) (n, parent *node, err error) {
+	n = s.root
+	for _, name := range splitKey(key) {
+		if !n.dir {
+			return nil, nil, s.newError(ErrNotDir, n.key)
+		}
+		parent = n
+		if n = n.children[name]; n == nil {
+			return nil, parent, s.newError(ErrKeyNotFound, path.Join("/", key))
+		}
+	}
+	return n, parent, nil
+}
+
+func splitKey(key string) []string {
+	key = strings.Trim(path.Clean("/"+key), "/")
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "/")
+}
+
+func (s *Server) get(key string, recursive bool) (*response, error) {
+	n, _, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return &response{Action: "get", Node: s.render(n, true, recursive)}, nil
+}
+
+// render returns the JSON form of n, with its children if list is set, and
+// theirs if recursive is.
+func (s *Server) render(n *node, list, recursive bool) *Node {
+	out := &Node{
+		Key:           n.key,
+		Dir:           n.dir,
+		ModifiedIndex: n.modified,
+		CreatedIndex:  n.created,
+	}
+	if n == s.root {
+		out.Key = ""
+	}
+	if !n.dir {
+		value := n.value
+		out.Value = &value
+	}
+	if n.expiration != nil {
+		expiration := *n.expiration
+		out.Expiration = &expiration
+		// Whole seconds left, rounded up like etcd does.
+		left := expiration.Sub(s.now())
+		out.TTL = int64((left + time.Second - 1) / time.Second)
+	}
+
+	if n.dir && list {
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			out.Nodes = append(out.Nodes, s.render(n.children[name], recursive, recursive))
+		}
+	}
+	return out
+}
+
+type putOptions struct {
+	value     string
+	dir       bool
+	ttl       time.Duration
+	prevExist string
+	prevValue string
+	prevIndex uint64
+	refresh   bool
+}
+
+func parsePutOptions(r *http.Request) (putOptions, error) {
+	opts := putOptions{
+		value:     r.Form.Get("value"),
+		dir:       r.Form.Get("dir") == "true",
+		prevExist: r.Form.Get("prevExist"),
+		prevValue: r.Form.Get("prevValue"),
+		refresh:   r.Form.Get("refresh") == "true",
+	}
+	if ttl := r.Form.Get("ttl"); ttl != "" {
+		seconds, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil {
+			return opts, &etcdError{ErrorCode: ErrInvalidField, Message: errorMessages[ErrInvalidField], Cause: "invalid ttl"}
+		}
+		opts.ttl = time.Duration(seconds) * time.Second
+	}
+	if prevIndex := r.Form.Get("prevIndex"); prevIndex != "" {
+		index, err := strconv.ParseUint(prevIndex, 10, 64)
+		if err != nil {
+			return opts, &etcdError{ErrorCode: ErrInvalidField, Message: errorMessages[ErrInvalidField], Cause: "invalid prevIndex"}
+		}
+		opts.prevIndex = index
+	}
+	if opts.refresh && opts.value != "" {
+		return opts, &etcdError{ErrorCode: ErrRefreshValue, Message: errorMessages[ErrRefreshValue]}
+	}
+	if opts.refresh && opts.ttl == 0 {
+		return opts, &etcdError{ErrorCode: ErrRefreshTTL, Message: errorMessages[ErrRefreshTTL]}
+	}
+	return opts, nil
+}
+
+func (s *Server) put(key string, opts putOptions) (*response, error) {
+	names := splitKey(key)
+	if len(names) == 0 {
+		return nil, s.newError(ErrRootReadOnly, "/")
+	}
+	key = "/" + strings.Join(names, "/")
+
+	// lookup fails with ErrNotDir if a value is in the way, before anything
+	// is written.
+	existing, _, err := s.lookup(key)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if isNotFound(err) {
+		existing = nil
+	}
+	if opts.refresh {
+		// Only the TTL changes, and watchers aren't told.
+		if existing == nil {
+			return nil, s.newError(ErrKeyNotFound, key)
+		}
+		opts.value = existing.value
+	}
+
+	compare := opts.prevValue != "" || opts.prevIndex != 0
+	action := "set"
+	switch {
+	case compare:
+		action = "compareAndSwap"
+		if existing == nil {
+			return nil, s.newError(ErrKeyNotFound, key)
+		}
+		if existing.dir {
+			return nil, s.newError(ErrNotFile, key)
+		}
+		if (opts.prevValue != "" && opts.prevValue != existing.value) || (opts.prevIndex != 0 && opts.prevIndex != existing.modified) {
+			cause := fmt.Sprintf("[%s != %s] [%d != %d]", opts.prevValue, existing.value, opts.prevIndex, existing.modified)
+			return nil, s.newError(ErrTestFailed, cause)
+		}
+	case opts.prevExist == "false":
+		action = "create"
+		if existing != nil {
+			return nil, s.newError(ErrNodeExist, key)
+		}
+	case opts.prevExist == "true":
+		action = "update"
+		if existing == nil {
+			return nil, s.newError(ErrKeyNotFound, key)
+		}
+	}
+	if existing != nil && existing.dir && !(opts.dir && action == "update") {
+		return nil, s.newError(ErrNotFile, key)
+	}
+	if existing != nil && !existing.dir && opts.dir {
+		return nil, s.newError(ErrNotDir, key)
+	}
+
+	// Create the parent directories, at the index of the key like etcd
+	// does, so that every index has an event.
+	dir := s.root
+	for _, name := range names[:len(names)-1] {
+		child := dir.children[name]
+		if child == nil {
+			child = &node{
+				key:      path.Join(dir.key, name),
+				dir:      true,
+				children: map[string]*node{},
+				created:  s.index + 1,
+				modified: s.index + 1,
+			}
+			dir.children[name] = child
+		}
+		dir = child
+	}
+
+	s.index++
+	var prev *Node
+	n := existing
+	if n == nil {
+		n = &node{key: key, dir: opts.dir, created: s.index}
+		if opts.dir {
+			n.children = map[string]*node{}
+		}
+		dir.children[names[len(names)-1]] = n
+	} else {
+		prev = s.render(n, false, false)
+	}
+	if !n.dir {
+		n.value = opts.value
+	}
+	n.modified = s.index
+	n.expiration = nil
+	if opts.ttl > 0 {
+		expiration := s.now().Add(opts.ttl).UTC()
+		n.expiration = &expiration
+	}
+
+	resp := &response{Action: action, Node: s.render(n, false, false), PrevNode: prev}
+	if !opts.refresh {
+		s.record(*resp)
+	}
+	return resp, nil
+}
+
+func isNotFound(err error) bool {
+	etcdErr, ok := err.(*etcdError)
+	return ok && etcdErr.ErrorCode == ErrKeyNotFound
+}
+
+func (s *Server) delete(key string, form map[string][]string) (*response, error) {
+	get := func(name string) string {
+		if values := form[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	n, parent, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if n == s.root {
+		return nil, s.newError(ErrRootReadOnly, "/")
+	}
+
+	action := "delete"
+	recursive := get("recursive") == "true"
+	if n.dir && !recursive {
+		if get("dir") != "true" {
+			return nil, s.newError(ErrNotFile, n.key)
+		}
+		if len(n.children) > 0 {
+			return nil, s.newError(ErrDirNotEmpty, n.key)
+		}
+	}
+	if prevValue, prevIndex := get("prevValue"), get("prevIndex"); prevValue != "" || prevIndex != "" {
+		action = "compareAndDelete"
+		if n.dir {
+			return nil, s.newError(ErrNotFile, n.key)
+		}
+		if (prevValue != "" && prevValue != n.value) || (prevIndex != "" && prevIndex != strconv.FormatUint(n.modified, 10)) {
+			return nil, s.newError(ErrTestFailed, fmt.Sprintf("[%s != %s] [%s != %d]", prevValue, n.value, prevIndex, n.modified))
+		}
+	}
+
+	s.index++
+	s.remove(n, parent)
+	resp := &response{
+		Action:   action,
+		Node:     &Node{Key: n.key, Dir: n.dir, ModifiedIndex: s.index, CreatedIndex: n.created},
+		PrevNode: s.render(n, false, false),
+	}
+	s.record(*resp)
+	return resp, nil
+}
+
+func (s *Server) remove(n, parent *node) {
+	delete(parent.children, path.Base(n.key))
+}
+
+// record appends an event to the history and wakes up watchers.
+func (s *Server) record(resp response) {
+	s.history = append(s.history, event{response: resp, index: s.index})
+	if s.HistorySize > 0 && len(s.history) > s.HistorySize {
+		s.history = append([]event(nil), s.history[len(s.history)-s.HistorySize:]...)
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) serveWatch(w http.ResponseWriter, r *http.Request, key string) {
+	recursive := r.Form.Get("recursive") == "true"
+	var waitIndex uint64
+	if wi := r.Form.Get("waitIndex"); wi != "" {
+		waitIndex, _ = strconv.ParseUint(wi, 10, 64)
+	}
+
+	s.mu.Lock()
+	if waitIndex == 0 {
+		waitIndex = s.index + 1
+	}
+	if len(s.history) > 0 && waitIndex < s.history[0].index {
+		err := s.newError(ErrEventIndexClear, fmt.Sprintf("the requested history has been cleared [%d/%d]", s.history[0].index, waitIndex))
+		index := s.index
+		s.mu.Unlock()
+		s.writeResponse(w, nil, err, index)
+		return
+	}
+	for {
+		for _, ev := range s.history {
+			if ev.index >= waitIndex && watches(key, ev.Node.Key, recursive) {
+				index := s.index
+				s.mu.Unlock()
+				resp := ev.response
+				s.writeResponse(w, &resp, nil, index)
+				return
+			}
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.stop:
+			return
+		}
+		s.mu.Lock()
+	}
+}
+
+// watches reports whether a watch of key sees a change of changed. Like in
+// etcd, recursive watches don't see hidden keys, those with an element
+// starting with an underscore, below the watched key.
+func watches(key, changed string, recursive bool) bool {
+	if key == changed {
+		return true
+	}
+	if !recursive {
+		return false
+	}
+
+	var rest string
+	switch {
+	case key == "/":
+		rest = strings.TrimPrefix(changed, "/")
+	case strings.HasPrefix(changed, key+"/"):
+		rest = strings.TrimPrefix(changed, key+"/")
+	default:
+		return false
+	}
+	for _, name := range strings.Split(rest, "/") {
+		if strings.HasPrefix(name, "_") {
+			return false
+		}
+	}
+	return true
+}
+
+// expireLoop deletes keys whose TTL ran out.
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		s.expire(s.root)
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) expire(dir *node) {
+	now := s.now()
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n := dir.children[name]
+		if n.expiration != nil && !now.Before(*n.expiration) {
+			s.index++
+			s.remove(n, dir)
+			s.record(response{
+				Action:   "expire",
+				Node:     &Node{Key: n.key, Dir: n.dir, ModifiedIndex: s.index, CreatedIndex: n.created},
+				PrevNode: s.render(n, false, false),
+			})
+			continue
+		}
+		if n.dir {
+			s.expire(n)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package etcdtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// newServer starts a server, and a client of it, until the test ends.
+func newServer(t *testing.T) (*Server, *etcd.Client) {
+	t.Helper()
+	s := NewServer()
+	t.Cleanup(s.Close)
+	client := etcd.NewClient(s.Machines())
+	t.Cleanup(client.Close)
+	return s, client
+}
+
+func TestWatchFromIndex(t *testing.T) {
+	s, client := newServer(t)
+	s.Set("/app/a", "1", 0)
+	s.Set("/app/b", "2", 0)
+	s.Set("/other", "3", 0)
+	s.Set("/app/_hidden", "4", 0)
+
+	tests := []struct {
+		name      string
+		key       string
+		index     uint64
+		recursive bool
+		want      string
+	}{
+		{name: "first change from the index", key: "/app", index: 2, recursive: true, want: "/app/b"},
+		{name: "key", key: "/other", index: 1, want: "/other"},
+		{name: "hidden key watched", key: "/app/_hidden", index: 1, want: "/app/_hidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Watch(tt.key, tt.index, tt.recursive, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Node.Key != tt.want {
+				t.Errorf("watch saw %s, want %s", resp.Node.Key, tt.want)
+			}
+		})
+	}
+
+	// Watches past the index wait for the next change, not counting hidden
+	// keys below the watched directory.
+	seen := make(chan *etcd.Response, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := client.Watch("/app", 0, true, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		seen <- resp
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Set("/app/_hidden", "5", 0)
+	s.Set("/app/c", "6", 0)
+	wg.Wait()
+	if resp := <-seen; resp.Node.Key != "/app/c" || resp.Action != "set" || resp.Node.ModifiedIndex != s.Index() {
+		t.Errorf("watch saw %s %s at %d, want set /app/c at %d", resp.Action, resp.Node.Key, resp.Node.ModifiedIndex, s.Index())
+	}
+}
+
+func TestWatchHistoryCleared(t *testing.T) {
+	s, client := newServer(t)
+	s.HistorySize = 2
+	for i := 0; i < 5; i++ {
+		s.Set("/key", strconv.Itoa(i), 0)
+	}
+
+	_, err := client.Watch("/key", 1, false, nil, nil)
+	if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != ErrEventIndexClear {
+		t.Fatalf("err = %v, want error %d", err, ErrEventIndexClear)
+	}
+
+	// The events kept are still there.
+	resp, err := client.Watch("/key", s.Index()-1, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Node.Value != "3" {
+		t.Errorf("watch saw %q, want 3", resp.Node.Value)
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	s, client := newServer(t)
+	var mu sync.Mutex
+	now := time.Now()
+	s.mu.Lock()
+	s.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	s.mu.Unlock()
+
+	if _, err := client.Set("/session", "abc", 10); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("/kept", "forever", 0)
+	resp, err := client.Get("/session", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Node.TTL != 10 || resp.Node.Expiration == nil {
+		t.Errorf("TTL = %d, expiration %v, want 10s left", resp.Node.TTL, resp.Node.Expiration)
+	}
+	index := s.Index()
+
+	mu.Lock()
+	now = now.Add(10 * time.Second)
+	mu.Unlock()
+	resp, err = client.Watch("/session", index+1, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Action != "expire" || resp.PrevNode == nil || resp.PrevNode.Value != "abc" {
+		t.Errorf("watch saw %s with previous node %+v, want the expiry of abc", resp.Action, resp.PrevNode)
+	}
+	if _, ok := s.Get("/session"); ok {
+		t.Error("/session still there after it expired")
+	}
+	if _, ok := s.Get("/kept"); !ok {
+		t.Error("/kept expired")
+	}
+}
+
+func TestEtcdIndexHeader(t *testing.T) {
+	s, client := newServer(t)
+	s.Set("/a", "1", 0)
+	s.Set("/b", "2", 0)
+
+	resp, err := client.Get("/a", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index is the cluster's, not the key's.
+	if resp.EtcdIndex != s.Index() || resp.Node.ModifiedIndex != 1 {
+		t.Errorf("EtcdIndex = %d, modifiedIndex %d, want %d and 1", resp.EtcdIndex, resp.Node.ModifiedIndex, s.Index())
+	}
+
+	for _, path := range []string{"/v2/keys/", "/v2/keys/missing"} {
+		r, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if got := r.Header.Get("X-Etcd-Index"); got != strconv.FormatUint(s.Index(), 10) {
+			t.Errorf("%s: X-Etcd-Index = %q, want %d", path, got, s.Index())
+		}
+	}
+}
+
+// refresh sends a refresh of key with form, and returns the etcd error code
+// of the answer, 0 if it succeeded.
+func refresh(t *testing.T, s *Server, key string, form url.Values) int {
+	t.Helper()
+	form.Set("refresh", "true")
+	req, err := http.NewRequest("PUT", s.URL+"/v2/keys"+key, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	var answer struct {
+		ErrorCode int `json:"errorCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	return answer.ErrorCode
+}
+
+func TestRefresh(t *testing.T) {
+	s, client := newServer(t)
+	s.Set("/lock", "holder-1", 10*time.Second)
+	index := s.Index()
+
+	if code := refresh(t, s, "/lock", url.Values{"ttl": {"30"}, "prevExist": {"true"}}); code != 0 {
+		t.Fatalf("refresh failed with error %d", code)
+	}
+	resp, err := client.Get("/lock", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Node.Value != "holder-1" || resp.Node.TTL != 30 || resp.Node.ModifiedIndex != index+1 {
+		t.Errorf("refreshed to %q with %ds left at %d, want holder-1 with 30s at %d", resp.Node.Value, resp.Node.TTL, resp.Node.ModifiedIndex, index+1)
+	}
+
+	// Watchers aren't told about refreshes.
+	s.Set("/other", "1", 0)
+	resp, err = client.Watch("/", index+1, true, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Node.Key != "/other" {
+		t.Errorf("watch saw %s %s, want the set of /other", resp.Action, resp.Node.Key)
+	}
+
+	for _, tt := range []struct {
+		key  string
+		form url.Values
+		code int
+	}{
+		{"/missing", url.Values{"ttl": {"30"}}, ErrKeyNotFound},
+		{"/lock", url.Values{"ttl": {"30"}, "value": {"holder-2"}}, ErrRefreshValue},
+		{"/lock", url.Values{}, ErrRefreshTTL},
+	} {
+		if code := refresh(t, s, tt.key, tt.form); code != tt.code {
+			t.Errorf("refresh of %s with %v: error %d, want %d", tt.key, tt.form, code, tt.code)
+		}
+	}
+	if value, _ := s.Get("/lock"); value != "holder-1" {
+		t.Errorf("/lock = %q after failed refreshes, want holder-1", value)
+	}
+}
+
+func TestSetThroughValue(t *testing.T) {
+	s, _ := newServer(t)
+	s.Set("/a", "value", 0)
+	index := s.Index()
+
+	err := s.Set("/a/b/c", "below a value", 0)
+	if etcdErr, ok := err.(*etcdError); !ok || etcdErr.ErrorCode != ErrNotDir {
+		t.Fatalf("err = %v, want error %d", err, ErrNotDir)
+	}
+	if keys := s.Keys("/"); !reflect.DeepEqual(keys, map[string]string{"/a": "value"}) || s.Index() != index {
+		t.Errorf("failed set left %v at index %d, want only /a at %d", keys, s.Index(), index)
+	}
+}
@@ -1,22 +1,103 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
 type ToFile struct {
-	OutFilePath string `long:"outfile" short:"o" env:"OUTFILE" description:"Where to write the resulting tarball (STDOUT if not set)"`
+	OutFilePath string `long:"outfile" short:"o" env:"OUTFILE" description:"Where to write the resulting tarball (STDOUT if not set), or the base directory when --key-template is set"`
+	ClusterName string `long:"cluster-name" short:"n" default:"etcd-cluster" env:"CLUSTER_NAME" description:"Cluster name to use in --key-template"`
+	KeyTemplate string `long:"key-template" env:"KEY_TEMPLATE" description:"Go template for the tarball path below --outfile. Fields: ClusterName, Time, Timestamp, EtcdIndex, Hostname, Ext"`
+	Mode        uint32 `long:"mode" env:"OUTFILE_MODE" default:"0600" base:"8" description:"Permissions of the written tarball"`
+
+	RedactOptions
 }
 
 var toFile ToFile
 
 func (o *ToFile) Execute(args []string) error {
-	node := getRootNode(opts.EtcdMachines)
-	buffer := FillTarballBuffer(&node)
-	return writeToFile(buffer, o.OutFilePath)
+	r, err := o.newRedactor()
+	if err != nil {
+		return err
+	}
+
+	response := getRootNode(opts.EtcdMachines)
+
+	path := o.OutFilePath
+	if o.KeyTemplate != "" {
+		if path, err = o.templatePath(response.EtcdIndex); err != nil {
+			return err
+		}
+	}
+
+	client := etcd.NewClient(opts.EtcdMachines)
+	defer client.Close()
+	m, err := backup.NewManifest(context.Background(), client, response)
+	if err != nil {
+		log.WithField("error", err).Warn("archiving without a complete description of the cluster")
+	}
+	if m, err = writeToFile(response.Node, m, path, os.FileMode(o.Mode), r); err != nil {
+		return err
+	}
+
+	switch strings.TrimSpace(path) {
+	case "-", "":
+	default:
+		o.recordStatus(strings.TrimSpace(path), m)
+	}
+	return nil
+}
+
+func (o *ToFile) recordStatus(path string, m backup.Manifest) {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.WithField("error", err).Warn("could not stat written file")
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	defaultStatusStore().record(backupStatus{
+		Cluster:     o.ClusterName,
+		Time:        info.ModTime().UTC(),
+		Destination: "file://" + filepath.ToSlash(path),
+		Size:        info.Size(),
+		Keys:        m.Keys,
+		EtcdIndex:   m.EtcdIndex,
+	})
+}
+
+// templatePath renders the key template below the outfile directory,
+// creating any directories the key names.
+func (o *ToFile) templatePath(etcdIndex uint64) (string, error) {
+	tmpl, err := parseKeyTemplate(o.KeyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid key template: %v", err)
+	}
+	key, err := renderKey(tmpl, newKeyFields(o.ClusterName, etcdIndex))
+	if err != nil {
+		return "", err
+	}
+
+	dir := strings.TrimSpace(o.OutFilePath)
+	if dir == "-" {
+		dir = ""
+	}
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
 }
 
 func init() {
@@ -27,30 +108,78 @@ func init() {
 	)
 }
 
-func writeToFile(buff *bytes.Buffer, path string) error {
+func writeToFile(node *etcd.Node, m backup.Manifest, path string, perm os.FileMode, r *backup.Redactor) (backup.Manifest, error) {
+	var err error
 	trimmedPath := strings.TrimSpace(path)
 	switch trimmedPath {
 	case "-", "":
-		if _, err := buff.WriteTo(os.Stdout); err != nil {
+		if m, err = backup.WriteArchive(os.Stdout, node, m, r); err != nil {
 			log.WithField("error", err).Warn("could not write to stdout")
-			return err
+			return m, err
 		}
 	default:
-		wc, err := os.Create(path)
+		err = writeFileAtomic(trimmedPath, perm, func(w io.Writer) error {
+			m, err = backup.WriteArchive(w, node, m, r)
+			return err
+		})
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error":    err,
-				"filepath": path,
-			}).Warn("could not create file for writing")
-			return err
+				"filepath": trimmedPath,
+			}).Warn("could not write to file")
+			return m, err
 		}
-		defer wc.Close()
+	}
 
-		if _, err := buff.WriteTo(wc); err != nil {
-			log.WithField("error", err).Warn("could not write to file")
-			return err
+	return m, nil
+}
+
+// writeFileAtomic lets write fill a temporary file next to path, and only
+// renames it into place once write succeeded and the data is on disk. A
+// crash or full disk leaves the previous file, never a truncated one.
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
 		}
+	}()
+
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
 	}
 
-	return nil
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory, making a rename within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/coreos/go-etcd/etcd"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// backupJob backs up one cluster to S3, once or continuously. Jobs share
+// nothing, so that the daemon can run one per cluster.
+type backupJob struct {
+	// name labels the logs and metrics of the cluster in the daemon, and
+	// is empty otherwise.
+	name     string
+	machines []string
+	s3       *ToS3
+	interval *S3OnInterval
+	status   statusStore
+	log      *log.Entry
+	metrics  *expvar.Map
+
+	sched    *scheduler
+	stale    *staleWatch
+	requests chan struct{}
+
+	// options reads the options of the job again on reload, if set.
+	options func() (*clusterOptions, error)
+
+	// Snapshots and reloads take turns.
+	mu sync.Mutex
+}
+
+// clusterMetrics holds the metrics of every cluster of the daemon, by name.
+var clusterMetrics = new(expvar.Map).Init()
+
+func newBackupJob(name string, machines []string, s3 *ToS3, interval *S3OnInterval, status statusStore) *backupJob {
+	j := &backupJob{
+		name:     name,
+		machines: machines,
+		s3:       s3,
+		interval: interval,
+		status:   status,
+		log:      log.NewEntry(log.StandardLogger()),
+		metrics:  metrics,
+		requests: make(chan struct{}, 1),
+	}
+	if name != "" {
+		j.log = j.log.WithField("cluster", name)
+		j.metrics = new(expvar.Map).Init()
+		clusterMetrics.Set(name, j.metrics)
+	}
+	j.status.log = j.log
+	return j
+}
+
+// check validates the options of the job, and of its schedule if it has one.
+func (j *backupJob) check() error {
+	if err := j.s3.checkOptions(); err != nil {
+		return err
+	}
+	if j.interval == nil {
+		return nil
+	}
+	if err := j.interval.check(); err != nil {
+		return err
+	}
+
+	var err error
+	j.sched, err = j.interval.scheduler()
+	if err != nil {
+		return err
+	}
+	j.sched.log = j.log
+	return nil
+}
+
+// run takes snapshots on schedule, after changes, and on request, until
+// stop is closed.
+func (j *backupJob) run(stop <-chan struct{}) {
+	o := j.interval
+	if o.StaleDuration > 0 {
+		j.stale = newStaleWatch(o.StaleDuration, realClock{})
+		go j.stale.Run(stop, func(lastSuccess time.Time) {
+			j.log.WithField("since", lastSuccess).Warn("no successful backup in a while")
+			j.mu.Lock()
+			defer j.mu.Unlock()
+			j.s3.notify(backupEvent{
+				Event:   eventStale,
+				Cluster: j.s3.ClusterName,
+				Error:   fmt.Sprintf("no successful backup since %s", lastSuccess.UTC().Format(time.RFC3339)),
+			})
+		})
+	}
+
+	// The go-etcd client isn't safe for concurrent use once requests fail,
+	// so the watch gets its own.
+	watcher := etcd.NewClient(j.machines)
+	events := make(chan *etcd.Response)
+	stopWatch := make(chan bool)
+	defer close(stopWatch)
+	go watcher.Watch("/", 0, true, events, stopWatch)
+	j.log.Info("listening for changes")
+
+	var changes <-chan *etcd.Response = events
+	var lock *leaderLock
+	if o.LockKey != "" {
+		lock = newLeaderLock(etcd.NewClient(j.machines), o.LockKey, o.LockID, o.LockTTLDuration)
+		lock.log = j.log
+		lock.metrics = j.metrics
+		go lock.Run()
+		// After the last snapshot, let another replica take over.
+		defer lock.Stop()
+	}
+	if ignored := j.bookkeepingKeys(); len(ignored) > 0 {
+		changes = ignoreKeys(events, ignored)
+	}
+
+	client := etcd.NewClient(j.machines)
+	j.sched.Run(changes, j.requests, stop, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		if lock != nil && !lock.IsLeader() {
+			j.log.Debug("not the backup leader, skipping snapshot")
+			if j.stale != nil {
+				// Keeping track of the leader's backups is up to the leader.
+				j.stale.Success()
+			}
+			return
+		}
+		if j.backup(client) == nil && j.stale != nil {
+			j.stale.Success()
+		}
+	})
+}
+
+// request asks for a snapshot right away.
+func (j *backupJob) request() {
+	select {
+	case j.requests <- struct{}{}:
+	default:
+		// One is already coming.
+	}
+}
+
+// reload reads the options of the job again, and swaps in those of the S3
+// upload and the schedule for the next snapshots. The AWS credentials are
+// resolved again either way, picking up changes to the shared credentials
+// file. What the running job is built around, the etcd machines, status,
+// lock and stale and shutdown timeouts, only changes on restart.
+func (j *backupJob) reload() {
+	if j.options == nil {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.s3.credentials = nil
+		return
+	}
+
+	s3, sched, err := j.reloadOptions()
+	if err != nil {
+		j.log.WithField("error", err).Error("could not reload the configuration, keeping the current one")
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.s3.credentials = nil
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s3.last = j.s3.last
+	j.s3 = s3
+	j.sched.update(sched)
+	j.log.Info("reloaded the configuration")
+}
+
+// reloadOptions reads and checks the options of the job again.
+func (j *backupJob) reloadOptions() (*ToS3, *scheduler, error) {
+	co, err := j.options()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := co.S3.checkOptions(); err != nil {
+		return nil, nil, err
+	}
+	if err := co.Interval.check(); err != nil {
+		return nil, nil, err
+	}
+	sched, err := co.Interval.scheduler()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := j.interval
+	restartOnly := map[string]bool{
+		"etcd-hosts":         strings.Join(co.EtcdMachines, ",") != strings.Join(j.machines, ","),
+		"status-key":         co.StatusKey != j.status.key,
+		"status-file":        co.StatusFile != j.status.file,
+		"lock-key":           co.Interval.LockKey != o.LockKey,
+		"lock-id":            co.Interval.LockID != o.LockID,
+		"lock-ttl":           co.Interval.LockTTLDuration != o.LockTTLDuration,
+		"notify-stale-after": co.Interval.StaleDuration != o.StaleDuration,
+		"shutdown-timeout":   co.Interval.ShutdownDuration != o.ShutdownDuration,
+	}
+	for option, changed := range restartOnly {
+		if changed {
+			j.log.WithField("option", option).Warn("option changed, restart to apply it")
+		}
+	}
+	return &co.S3, sched, nil
+}
+
+// bookkeepingKeys are the keys etcdbk itself writes to while backing up,
+// which are not a change worth backing up.
+func (j *backupJob) bookkeepingKeys() []string {
+	var keys []string
+	if j.interval != nil && j.interval.LockKey != "" {
+		keys = append(keys, path.Join("/", j.interval.LockKey))
+	}
+	if j.status.key != "" {
+		keys = append(keys, path.Join("/", j.status.key))
+	}
+	return keys
+}
+
+// runJobs runs jobs until SIGTERM or SIGINT, then waits up to timeout for
+// their running and last snapshots, and the notifications about them.
+// SIGUSR1 requests a snapshot of every job, and SIGHUP reloads them.
+func runJobs(jobs []*backupJob, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGHUP)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *backupJob) {
+			defer wg.Done()
+			j.run(stop)
+		}(j)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			log.Info("snapshot requested")
+			for _, j := range jobs {
+				j.request()
+			}
+			continue
+		case syscall.SIGHUP:
+			log.Info("reloading")
+			for _, j := range jobs {
+				j.reload()
+			}
+			continue
+		}
+
+		log.WithField("signal", sig).Info("shutting down")
+		signal.Stop(signals)
+		close(stop)
+		break
+	}
+
+	deadline := time.Now().Add(timeout)
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return fmt.Errorf("snapshots still running after %s, giving up", timeout)
+	}
+	select {
+	case <-notificationsDone():
+	case <-time.After(time.Until(deadline)):
+		return fmt.Errorf("notifications still being sent after %s, giving up", timeout)
+	}
+	log.Info("stopped")
+	return nil
+}
+
+// backup takes a snapshot, then records and notifies the outcome. A
+// snapshot that is skipped because nothing changed only records when it was
+// checked.
+func (j *backupJob) backup(client *etcd.Client) error {
+	status, skipped, err := j.snapshot(client)
+	if err != nil {
+		j.log.WithField("error", err).Error("snapshot failed")
+		j.metrics.Add("backups_failed", 1)
+		j.s3.notify(backupEvent{
+			Event:   eventFailure,
+			Cluster: j.s3.ClusterName,
+			Error:   err.Error(),
+		})
+		return err
+	}
+
+	j.s3.last = &status
+	j.status.record(status)
+	lastSuccess := new(expvar.Int)
+	lastSuccess.Set(time.Now().Unix())
+	j.metrics.Set("last_success_time", lastSuccess)
+	if skipped {
+		j.metrics.Add("backups_skipped", 1)
+		return nil
+	}
+	j.metrics.Add("backups_uploaded", 1)
+	j.s3.notify(backupEvent{
+		Event:   eventSuccess,
+		Cluster: j.s3.ClusterName,
+		Status:  &status,
+	})
+	return nil
+}
+
+func (j *backupJob) snapshot(client *etcd.Client) (backupStatus, bool, error) {
+	j.log.Info("taking a snapshot")
+
+	response, err := fetchRoot(client)
+	if err != nil {
+		return backupStatus{}, false, fmt.Errorf("could not retrieve etcd root node: %v", err)
+	}
+
+	hash := backup.ContentHash(response.Node, j.bookkeepingKeys())
+	if last, unchanged := j.s3.unchanged(j.status, response.EtcdIndex, hash); unchanged && !j.s3.Force {
+		j.log.WithFields(log.Fields{
+			"destination": last.Destination,
+			"since":       last.Time,
+		}).Info("cluster unchanged since the last upload, skipping snapshot")
+
+		status := *last
+		checked := time.Now().UTC()
+		status.Checked = &checked
+		return status, true, nil
+	}
+
+	var buffer bytes.Buffer
+	m, err := backup.NewManifest(context.Background(), client, response)
+	if err != nil {
+		j.log.WithField("error", err).Warn("archiving without a complete description of the cluster")
+	}
+	m, err = backup.WriteArchive(&buffer, response.Node, m, j.s3.redactor)
+	if err != nil {
+		return backupStatus{}, false, fmt.Errorf("could not write tarball: %v", err)
+	}
+
+	auth, err := j.s3.awsCredentials().Auth()
+	if err != nil {
+		return backupStatus{}, false, fmt.Errorf("could not resolve AWS credentials: %v", err)
+	}
+
+	key, err := j.s3.objectKey(response.EtcdIndex)
+	if err != nil {
+		return backupStatus{}, false, fmt.Errorf("could not name the archive: %v", err)
+	}
+	meta := map[string]string{
+		metaCluster:     j.s3.ClusterName,
+		metaEtcdIndex:   strconv.FormatUint(response.EtcdIndex, 10),
+		metaKeyCount:    strconv.Itoa(m.Keys),
+		metaContentHash: hash,
+	}
+
+	s3Writer := j.s3.s3Writer(auth)
+	if err := s3Writer.WriteToS3(key, buffer.Bytes(), meta); err != nil {
+		return backupStatus{}, false, fmt.Errorf("could not write to bucket: %v", err)
+	}
+	j.log.WithField("key", key).Info("wrote to bucket")
+
+	if j.s3.Keep > 0 {
+		if deleted, err := j.s3.prune(s3Writer); err != nil {
+			j.log.WithField("error", err).Warn("could not delete old archives")
+		} else if len(deleted) > 0 {
+			j.log.WithField("keys", deleted).Info("deleted old archives")
+		}
+	}
+
+	return backupStatus{
+		Cluster:     j.s3.ClusterName,
+		Time:        time.Now().UTC(),
+		Destination: fmt.Sprintf("s3://%s/%s", j.s3.AwsBucket, key),
+		Size:        int64(buffer.Len()),
+		Keys:        m.Keys,
+		EtcdIndex:   response.EtcdIndex,
+		ContentHash: hash,
+	}, false, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestJobReload(t *testing.T) {
+	l := testLocation("http://127.0.0.1:9000")
+	j := newBackupJob("", nil, &ToS3{S3Location: l}, &S3OnInterval{MaxPeriodDuration: time.Hour, MinPeriodDuration: time.Minute, LockTTLDuration: 30 * time.Second}, statusStore{})
+	if err := j.check(); err != nil {
+		t.Fatal(err)
+	}
+	last := &backupStatus{EtcdIndex: 42}
+	j.s3.last = last
+
+	reloaded := l
+	reloaded.AwsBucket = "other-bucket"
+	var options *clusterOptions
+	var optionsErr error
+	j.options = func() (*clusterOptions, error) { return options, optionsErr }
+
+	// Swapped in.
+	options = &clusterOptions{
+		S3:       ToS3{S3Location: reloaded},
+		Interval: S3OnInterval{MaxPeriodDuration: 2 * time.Hour, MinPeriodDuration: time.Minute, LockTTLDuration: 30 * time.Second},
+	}
+	j.reload()
+	if j.s3.AwsBucket != "other-bucket" {
+		t.Errorf("bucket = %q after reload, want other-bucket", j.s3.AwsBucket)
+	}
+	if j.s3.last != last {
+		t.Error("last backup forgotten on reload")
+	}
+	if j.sched.maxPeriod != 2*time.Hour {
+		t.Errorf("max period = %s after reload, want 2h", j.sched.maxPeriod)
+	}
+
+	// Kept when the new options can't be read, or are invalid.
+	current := j.s3
+	optionsErr = errors.New("config file gone")
+	j.reload()
+	optionsErr = nil
+	options = &clusterOptions{S3: ToS3{S3Location: func() S3Location {
+		invalid := reloaded
+		invalid.AwsSignature = "v3"
+		return invalid
+	}()}}
+	j.reload()
+	if j.s3 != current {
+		t.Error("options swapped for unusable ones")
+	}
+}
+
+func TestLockTTL(t *testing.T) {
+	for _, tt := range []struct {
+		ttl time.Duration
+		ok  bool
+	}{
+		{0, false},
+		{-time.Second, false},
+		{time.Nanosecond, false},
+		{999 * time.Millisecond, false},
+		{time.Second, true},
+		{30 * time.Second, true},
+	} {
+		interval := &S3OnInterval{MaxPeriodDuration: time.Hour, MinPeriodDuration: time.Minute, LockKey: "_etcdbk/leader", LockTTLDuration: tt.ttl}
+		j := newBackupJob("", nil, &ToS3{S3Location: testLocation("http://127.0.0.1:9000")}, interval, statusStore{})
+		if err := j.check(); (err == nil) != tt.ok {
+			t.Errorf("lock TTL of %s: err = %v, want ok %t", tt.ttl, err, tt.ok)
+		}
+	}
+}
+
+func TestJobBackup(t *testing.T) {
+	s3srv := newS3Server(t)
+	srv := etcdtest.NewServer()
+	defer srv.Close()
+	srv.Set("/apps/web/config", `{"port": 8080}`, 0)
+	srv.Set("/apps/web/password", "hunter2", 0)
+
+	o := &ToS3{S3Location: testLocation(s3srv.URL())}
+	o.RedactBuiltin = true
+	status := statusStore{machines: srv.Machines(), key: "_etcdbk/status"}
+	j := newBackupJob("job-backup", srv.Machines(), o, nil, status)
+	if err := j.check(); err != nil {
+		t.Fatal(err)
+	}
+	client := etcd.NewClient(srv.Machines())
+	defer client.Close()
+	s3w := o.s3Writer(testAuth)
+	bucket, err := s3w.bucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uploaded lists the archives in the bucket.
+	uploaded := func() []string {
+		list, err := bucket.List("", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, key := range list.Contents {
+			keys = append(keys, key.Key)
+		}
+		return keys
+	}
+
+	index := srv.Index()
+	if err := j.backup(client); err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("etcd/prod/%d.tar.gz", index)
+	if got := uploaded(); len(got) != 1 || got[0] != key {
+		t.Fatalf("uploaded %q, want %s", got, key)
+	}
+
+	// The archive holds the keys, redacted, and the metadata describes it.
+	resp, err := bucket.Head(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for name, want := range map[string]string{
+		metaCluster:   "prod",
+		metaEtcdIndex: fmt.Sprint(index),
+		metaKeyCount:  "2",
+	} {
+		if got := resp.Header.Get("x-amz-meta-" + name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	r, err := bucket.GetReader(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, m, err := backup.List(context.Background(), r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.EtcdIndex != index || !m.Redacted || m.Cluster == nil {
+		t.Errorf("manifest = %+v, want index %d, redacted, and the cluster described", m, index)
+	}
+	for _, e := range entries {
+		if e.Key == "/apps/web/password" && e.Size != len(backup.DefaultRedactMarker) {
+			t.Errorf("password archived with %d bytes, want the marker", e.Size)
+		}
+	}
+
+	// The status is recorded in etcd.
+	value, ok := srv.Get("/_etcdbk/status")
+	if !ok {
+		t.Fatal("no status recorded")
+	}
+	var recorded backupStatus
+	if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded.Cluster != "prod" || recorded.Destination != "s3://etcdbackups/"+key || recorded.Keys != 2 || recorded.EtcdIndex != index {
+		t.Errorf("recorded %+v", recorded)
+	}
+
+	// Recording the status doesn't count as a change.
+	if err := j.backup(client); err != nil {
+		t.Fatal(err)
+	}
+	if got := uploaded(); len(got) != 1 {
+		t.Errorf("uploaded %q for an unchanged cluster", got)
+	}
+
+	srv.Set("/apps/web/config", `{"port": 9090}`, 0)
+	if err := j.backup(client); err != nil {
+		t.Fatal(err)
+	}
+	if got := uploaded(); len(got) != 2 {
+		t.Errorf("uploaded %q, want a second archive after a change", got)
+	}
+
+	for name, want := range map[string]string{
+		"backups_uploaded": "2",
+		"backups_skipped":  "1",
+	} {
+		if got := j.metrics.Get(name); got == nil || got.String() != want {
+			t.Errorf("%s = %v, want %s", name, got, want)
+		}
+	}
+
+	// Failures are returned and counted.
+	o.AwsBucket = "missing"
+	srv.Set("/apps/web/config", `{"port": 7070}`, 0)
+	if err := j.backup(client); err == nil {
+		t.Error("upload to a missing bucket succeeded")
+	}
+	if got := j.metrics.Get("backups_failed"); got == nil || got.String() != "1" {
+		t.Errorf("backups_failed = %v, want 1", got)
+	}
+}
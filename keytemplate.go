@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Archives are always gzipped tarballs.
+const archiveExt = "tar.gz"
+
+// KeyFields holds the values a key template can refer to, e.g.
+//
+//	etcd/{{.ClusterName}}/{{.Time.Format "2006/01/02"}}/{{.ClusterName}}-{{.EtcdIndex}}.{{.Ext}}
+type KeyFields struct {
+	ClusterName string
+	Time        time.Time // UTC
+	EtcdIndex   uint64
+	Hostname    string
+	Ext         string
+}
+
+// Timestamp is the snapshot time in RFC3339.
+func (f KeyFields) Timestamp() string {
+	return f.Time.Format(time.RFC3339)
+}
+
+func newKeyFields(clusterName string, etcdIndex uint64) KeyFields {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithField("error", err).Warn("could not determine hostname")
+	}
+
+	return KeyFields{
+		ClusterName: clusterName,
+		Time:        time.Now().UTC(),
+		EtcdIndex:   etcdIndex,
+		Hostname:    hostname,
+		Ext:         archiveExt,
+	}
+}
+
+func parseKeyTemplate(text string) (*template.Template, error) {
+	return template.New("key").Parse(text)
+}
+
+// renderKey executes tmpl, dropping any leading slashes from the result.
+func renderKey(tmpl *template.Template, fields KeyFields) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+
+	key := strings.TrimLeft(buf.String(), "/")
+	if key == "" {
+		return "", errors.New("key template rendered an empty key")
+	}
+	return key, nil
+}
+
+// Patterns for the fields that vary between snapshots of one cluster.
+var keyFieldPatterns = map[string]string{
+	"{{.Timestamp}}": `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(Z|[+-]\d\d:\d\d)`,
+	"{{.EtcdIndex}}": `\d+`,
+}
+
+// keyMatcher describes the keys tmpl renders for clusterName: the literal
+// prefix they all share, suitable for listing a bucket, and a pattern that
+// matches them in full. Varying fields match within a path element. own
+// reports whether the cluster name is a path element of its own, i.e.
+// whether only keys of clusterName can match; with
+// {{.ClusterName}}-{{.Hostname}}, the keys of prod-eu match for prod.
+func keyMatcher(tmpl *template.Template, clusterName string) (prefix string, pattern *regexp.Regexp, own bool, err error) {
+	var prefixBuf, patternBuf bytes.Buffer
+	// skeleton is a key the template could render, with the cluster name
+	// standing out.
+	var skeleton strings.Builder
+	const clusterMark = "\x00"
+	literal := true
+
+	for _, node := range tmpl.Tree.Root.Nodes {
+		var text string
+		switch n := node.(type) {
+		case *parse.TextNode:
+			text = string(n.Text)
+			skeleton.WriteString(text)
+		case *parse.ActionNode:
+			switch n.String() {
+			case "{{.ClusterName}}":
+				text = clusterName
+				skeleton.WriteString(clusterMark)
+			case "{{.Ext}}":
+				text = archiveExt
+				skeleton.WriteString(text)
+			default:
+				literal = false
+				p, ok := keyFieldPatterns[n.String()]
+				if !ok {
+					p = actionPattern(n)
+				}
+				patternBuf.WriteString(p)
+				skeleton.WriteString(p)
+				continue
+			}
+		default:
+			literal = false
+			patternBuf.WriteString("[^/]*")
+			skeleton.WriteString("x")
+			continue
+		}
+
+		if patternBuf.Len() == 0 {
+			text = strings.TrimLeft(text, "/")
+		}
+		patternBuf.WriteString(regexp.QuoteMeta(text))
+		if literal {
+			prefixBuf.WriteString(text)
+		}
+	}
+
+	for _, element := range strings.Split(strings.TrimLeft(skeleton.String(), "/"), "/") {
+		own = own || element == clusterMark
+	}
+	pattern, err = regexp.Compile("^" + patternBuf.String() + "$")
+	return prefixBuf.String(), pattern, own, err
+}
+
+// actionPattern matches what an action renders: anything within a path
+// element, or, for {{.Time.Format "2006/01/02"}}, within as many as the
+// layout spans.
+func actionPattern(n *parse.ActionNode) string {
+	if len(n.Pipe.Cmds) == 1 {
+		args := n.Pipe.Cmds[0].Args
+		if len(args) == 2 && args[0].String() == ".Time.Format" {
+			if layout, ok := args[1].(*parse.StringNode); ok {
+				elements := strings.Split(layout.Text, "/")
+				for i, element := range elements {
+					if element != "" {
+						elements[i] = "[^/]+"
+					}
+				}
+				return strings.Join(elements, "/")
+			}
+		}
+	}
+	return "[^/]+"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyMatcher(t *testing.T) {
+	tests := []struct {
+		template string
+		prefix   string
+		own      bool
+		match    []string
+		noMatch  []string
+	}{
+		{
+			template: "{{.ClusterName}}-{{.Timestamp}}.{{.Ext}}",
+			prefix:   "prod-",
+			match:    []string{"prod-2016-02-11T10:00:00Z.tar.gz", "prod-2016-02-11T10:00:00+01:00.tar.gz"},
+			noMatch:  []string{"prod-eu-2016-02-11T10:00:00Z.tar.gz", "prod-2016-02-11T10:00:00Z.tar", "backups/prod-2016-02-11T10:00:00Z.tar.gz"},
+		},
+		{
+			template: "{{.ClusterName}}-{{.Hostname}}-{{.EtcdIndex}}.{{.Ext}}",
+			prefix:   "prod-",
+			match:    []string{"prod-backup-1-42.tar.gz", "prod-eu-backup-1-42.tar.gz"},
+			noMatch:  []string{"prod-a/b-42.tar.gz", "prod--42.tar.gz"},
+		},
+		{
+			template: "/etcd/{{.ClusterName}}/{{.EtcdIndex}}.{{.Ext}}",
+			prefix:   "etcd/prod/",
+			own:      true,
+			match:    []string{"etcd/prod/42.tar.gz"},
+			noMatch:  []string{"etcd/prod-eu/42.tar.gz", "etcd/prod/x/42.tar.gz"},
+		},
+		{
+			template: `etcd/{{.ClusterName}}/{{.Time.Format "2006/01/02"}}/{{.ClusterName}}-{{.EtcdIndex}}.{{.Ext}}`,
+			prefix:   "etcd/prod/",
+			own:      true,
+			match:    []string{"etcd/prod/2016/02/11/prod-42.tar.gz"},
+			noMatch:  []string{"etcd/prod/2016/02/prod-42.tar.gz", "etcd/prod/2016/02/11/12/prod-42.tar.gz"},
+		},
+		{
+			template: "{{.Hostname}}/{{.ClusterName}}",
+			own:      true,
+			match:    []string{"backup-1/prod"},
+			noMatch:  []string{"backup-1/prod-eu", "a/b/prod"},
+		},
+		{
+			template: "{{if .Hostname}}{{.Hostname}}{{end}}/{{.ClusterName}}-{{.EtcdIndex}}.{{.Ext}}",
+			match:    []string{"backup-1/prod-42.tar.gz", "/prod-42.tar.gz"},
+			noMatch:  []string{"a/b/prod-42.tar.gz"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := parseKeyTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix, pattern, own, err := keyMatcher(tmpl, "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefix != tt.prefix {
+				t.Errorf("prefix = %q, want %q", prefix, tt.prefix)
+			}
+			if own != tt.own {
+				t.Errorf("own = %t, want %t", own, tt.own)
+			}
+			for _, key := range tt.match {
+				if !pattern.MatchString(key) {
+					t.Errorf("%s doesn't match %s", pattern, key)
+				}
+			}
+			for _, key := range tt.noMatch {
+				if pattern.MatchString(key) {
+					t.Errorf("%s matches %s", pattern, key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/coreos/go-etcd/etcd"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// leaderLock elects a single active backup process among replicas. The
+// holder of the lock creates key with a TTL and keeps refreshing it with
+// CompareAndSwap; everyone else watches the key and tries to take it over
+// once it expires or is deleted. A holder that stops deletes the key, so
+// that another replica takes over right away.
+type leaderLock struct {
+	client *etcd.Client
+	key    string
+	id     string
+	ttl    time.Duration
+
+	// log and metrics label what the lock is for.
+	log     *log.Entry
+	metrics *expvar.Map
+
+	mu     sync.Mutex
+	leader string
+
+	// stop is closed to make Run return, which closes done.
+	stop chan bool
+	done chan struct{}
+}
+
+func newLeaderLock(client *etcd.Client, key, id string, ttl time.Duration) *leaderLock {
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+
+	return &leaderLock{
+		client: client,
+		key:    path.Join("/", key),
+		id:     id,
+		ttl:    ttl,
+
+		log:     log.NewEntry(log.StandardLogger()),
+		metrics: metrics,
+
+		stop: make(chan bool),
+		done: make(chan struct{}),
+	}
+}
+
+// IsLeader tells whether this process currently holds the lock.
+func (l *leaderLock) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader == l.id
+}
+
+func (l *leaderLock) setLeader(leader string) {
+	l.mu.Lock()
+	changed := l.leader != leader
+	l.leader = leader
+	l.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	isLeader := new(expvar.Int)
+	if leader == l.id {
+		isLeader.Set(1)
+	}
+	leaderVar := new(expvar.String)
+	leaderVar.Set(leader)
+	l.metrics.Set("leader", leaderVar)
+	l.metrics.Set("is_leader", isLeader)
+
+	l.log.WithFields(log.Fields{
+		"leader": leader,
+		"self":   l.id,
+	}).Info("backup leader changed")
+}
+
+func (l *leaderLock) ttlSeconds() uint64 {
+	if seconds := uint64(l.ttl / time.Second); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+// Run campaigns for the lock until Stop is called.
+func (l *leaderLock) Run() {
+	defer close(l.done)
+	for !l.stopped() {
+		resp, err := l.client.Create(l.key, l.id, l.ttlSeconds())
+		switch {
+		case err == nil:
+			l.lead(resp.Node.ModifiedIndex)
+		case backup.IsEtcdError(err, backup.EtcdErrNodeExist):
+			l.follow()
+		default:
+			l.log.WithField("error", err).Warn("could not campaign for backup leadership")
+			l.setLeader("")
+			l.sleep(l.ttl / 3)
+		}
+	}
+}
+
+// Stop makes Run give up the lock and return, and waits for it to.
+func (l *leaderLock) Stop() {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	<-l.done
+}
+
+func (l *leaderLock) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, and reports whether Stop was called meanwhile.
+func (l *leaderLock) sleep(d time.Duration) bool {
+	select {
+	case <-l.stop:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// lead refreshes the lock until that fails, or until Stop is called, which
+// releases it.
+func (l *leaderLock) lead(index uint64) {
+	l.setLeader(l.id)
+
+	for {
+		if l.sleep(l.ttl / 3) {
+			l.release(index)
+			return
+		}
+
+		resp, err := l.client.CompareAndSwap(l.key, l.id, l.ttlSeconds(), l.id, index)
+		if err != nil {
+			l.log.WithField("error", err).Warn("could not refresh backup leadership")
+			l.setLeader("")
+			return
+		}
+		index = resp.Node.ModifiedIndex
+	}
+}
+
+// release deletes the lock, unless it changed since index.
+func (l *leaderLock) release(index uint64) {
+	if _, err := l.client.CompareAndDelete(l.key, l.id, index); err != nil {
+		l.log.WithField("error", err).Warn("could not release backup leadership")
+	} else {
+		l.log.Info("released backup leadership")
+	}
+	l.setLeader("")
+}
+
+// follow waits for the lock held by another process to change.
+func (l *leaderLock) follow() {
+	resp, err := l.client.Get(l.key, false, false)
+	if err != nil {
+		if !backup.IsEtcdError(err, backup.EtcdErrKeyNotFound) {
+			l.log.WithField("error", err).Warn("could not read backup leader")
+			l.sleep(l.ttl / 3)
+		}
+		return
+	}
+
+	// A lock still carrying our own id survived a failed refresh; carry on
+	// leading.
+	if resp.Node.Value == l.id {
+		l.lead(resp.Node.ModifiedIndex)
+		return
+	}
+
+	l.setLeader(resp.Node.Value)
+	if _, err := l.client.Watch(l.key, resp.EtcdIndex+1, false, nil, l.stop); err != nil && !l.stopped() {
+		l.log.WithField("error", err).Debug("stopped watching backup leader")
+		l.sleep(l.ttl / 3)
+	}
+}
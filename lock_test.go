@@ -0,0 +1,92 @@
+package main
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// startLock campaigns for key on srv as id until the test ends.
+func startLock(t *testing.T, srv *etcdtest.Server, key, id string) *leaderLock {
+	t.Helper()
+	// The TTL keeps the lock from expiring, so that only releasing it lets
+	// another replica take over within the test.
+	l := newLeaderLock(etcd.NewClient(srv.Machines()), key, id, time.Minute)
+	l.metrics = new(expvar.Map).Init()
+	go l.Run()
+	t.Cleanup(l.Stop)
+	return l
+}
+
+// waitFor waits for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLeaderLockHandover(t *testing.T) {
+	srv := etcdtest.NewServer()
+	defer srv.Close()
+
+	a := startLock(t, srv, "_etcdbk/leader", "a")
+	waitFor(t, "a to lead", a.IsLeader)
+	b := startLock(t, srv, "_etcdbk/leader", "b")
+	waitFor(t, "b to follow a", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.leader == "a"
+	})
+	if b.IsLeader() {
+		t.Fatal("both lead")
+	}
+
+	a.Stop()
+	if a.IsLeader() {
+		t.Error("a still leads after stopping")
+	}
+	waitFor(t, "b to take over", b.IsLeader)
+	if leader, _ := srv.Get("/_etcdbk/leader"); leader != "b" {
+		t.Errorf("lock held by %q, want b", leader)
+	}
+
+	// A follower stops without touching the lock.
+	c := startLock(t, srv, "_etcdbk/leader", "c")
+	waitFor(t, "c to follow b", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.leader == "b"
+	})
+	c.Stop()
+	if leader, _ := srv.Get("/_etcdbk/leader"); leader != "b" {
+		t.Errorf("lock held by %q after a follower stopped, want b", leader)
+	}
+
+	b.Stop()
+	if _, ok := srv.Get("/_etcdbk/leader"); ok {
+		t.Error("lock still held after its leader stopped")
+	}
+}
+
+func TestLeaderLockKeepsTakenOverLock(t *testing.T) {
+	srv := etcdtest.NewServer()
+	defer srv.Close()
+
+	a := startLock(t, srv, "lock", "a")
+	waitFor(t, "a to lead", a.IsLeader)
+	// Another replica took the lock over, e.g. after a partition.
+	srv.Set("/lock", "b", time.Minute)
+
+	a.Stop()
+	if leader, _ := srv.Get("/lock"); leader != "b" {
+		t.Errorf("lock held by %q, want it left to b", leader)
+	}
+}
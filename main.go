@@ -1,7 +1,9 @@
 package main // import "github.com/christian-blades-cb/etcdbk"
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/jessevdk/go-flags"
 	"os"
@@ -10,6 +12,12 @@ import (
 var opts struct {
 	EtcdMachines []string `long:"etcd-hosts" short:"e" required:"true" default:"http://127.0.0.1:4001" env:"ETCD_HOSTS" env-delim:"," description:"etcd machines"`
 	Verbose      func()   `long:"debug" short:"v" description:"verbose logging"`
+	MetricsAddr  string   `long:"metrics-addr" env:"METRICS_ADDR" description:"Address on which long-running commands serve metrics, as JSON at /debug/vars"`
+	StatusKey    string   `long:"status-key" env:"STATUS_KEY" description:"etcd key recording the last successful backup, e.g. /_etcdbk/status"`
+	StatusFile   string   `long:"status-file" env:"STATUS_FILE" description:"Local file recording the last successful backup"`
+	FetchWorkers int      `long:"fetch-workers" env:"FETCH_WORKERS" description:"Fetch the tree one directory at a time with this many concurrent requests, instead of in a single request"`
+	Config       string   `long:"config" env:"CONFIG_FILE" description:"INI file setting the defaults of options, in sections per command"`
+	Profile      string   `long:"profile" env:"CONFIG_PROFILE" description:"Also apply the [cluster \"NAME\"] section of the --config file"`
 }
 
 var parser = flags.NewParser(&opts, flags.Default)
@@ -22,21 +30,39 @@ func init() {
 }
 
 func main() {
+	if err := applyConfig(os.Args[1:]); err != nil {
+		log.WithField("error", err).Fatal("could not read configuration file")
+	}
+
 	if _, err := parser.Parse(); err != nil {
-		log.Fatal("could not parse options")
+		if _, ok := err.(*flags.Error); ok {
+			log.Fatal("could not parse options")
+		}
+		log.WithField("error", err).Fatal("command failed")
 	}
 }
 
-func getRootNode(machines []string) etcd.Node {
+// cluster is the cluster the options point to.
+func cluster() backup.Cluster {
+	return backup.Cluster{Machines: opts.EtcdMachines, FetchWorkers: opts.FetchWorkers}
+}
+
+// fetchRoot retrieves the whole tree, in a single recursive request unless
+// --fetch-workers is set.
+func fetchRoot(client *etcd.Client) (*etcd.Response, error) {
+	return backup.Fetch(context.Background(), client, opts.FetchWorkers)
+}
+
+func getRootNode(machines []string) *etcd.Response {
 	log.WithField("etcdhosts", machines).Debug("connecting to etcd cluster")
 	client := etcd.NewClient(machines)
 	defer client.Close()
 
 	log.Debug("requesting root node")
-	response, err := client.Get("/", false, true)
+	response, err := fetchRoot(client)
 	if err != nil {
 		log.WithField("error", err).Fatal("could not retrieve value for key")
 	}
 
-	return *response.Node
+	return response
 }
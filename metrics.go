@@ -0,0 +1,24 @@
+package main
+
+import (
+	"expvar"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// metrics are published as JSON at /debug/vars on the --metrics-addr
+// listener.
+var metrics = expvar.NewMap("etcdbk")
+
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	go func() {
+		log.WithField("addr", addr).Info("serving metrics")
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.WithField("error", err).Error("could not serve metrics")
+		}
+	}()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type Mirror struct {
+	Source              []string     `long:"source" env:"MIRROR_SOURCE" env-delim:"," required:"true" description:"etcd machines of the cluster to copy from"`
+	Target              []string     `long:"target" env:"MIRROR_TARGET" env-delim:"," required:"true" description:"etcd machines of the cluster to copy to"`
+	StateKey            string       `long:"state-key" env:"MIRROR_STATE_KEY" default:"/_etcdbk/mirror" description:"Key of the target cluster recording the last applied index, to resume from after a restart"`
+	StateFile           string       `long:"state-file" env:"MIRROR_STATE_FILE" description:"Local file recording the last applied index, instead of --state-key"`
+	LagInterval         func(string) `long:"lag-interval" env:"MIRROR_LAG_INTERVAL" default:"10s" description:"How often to report the replication lag and record the last applied index"`
+	LagIntervalDuration time.Duration
+}
+
+var mirror Mirror
+
+// Delay before retrying after the source or the target failed.
+var mirrorRetryDelay = 5 * time.Second
+
+// mirrorState is what the mirror needs to resume after a restart.
+type mirrorState struct {
+	Index uint64    `json:"index"`
+	Time  time.Time `json:"time"`
+}
+
+func (o *Mirror) Execute(args []string) error {
+	if err := o.check(); err != nil {
+		return err
+	}
+	serveMetrics(opts.MetricsAddr)
+
+	source := etcd.NewClient(o.Source)
+	defer source.Close()
+	target := etcd.NewClient(o.Target)
+	defer target.Close()
+
+	index, err := o.readState(target)
+	if err != nil {
+		log.WithField("error", err).Warn("could not read mirror state, copying everything")
+	} else if index > 0 {
+		log.WithField("index", index).Info("resuming mirror")
+	}
+
+	lag := &mirrorLag{syncedAt: time.Now()}
+	for {
+		if index == 0 {
+			if index, err = o.copyAll(source, target); err != nil {
+				log.WithField("error", err).Warn("could not copy source cluster, retrying")
+				time.Sleep(mirrorRetryDelay)
+				continue
+			}
+			o.writeState(target, index)
+		}
+
+		index, err = o.follow(source, target, index, lag)
+		if backup.IsEtcdError(err, backup.EtcdErrEventIndexCleared) {
+			log.WithField("index", index).Warn("source no longer has the changes since the last applied index, copying everything again")
+			index = 0
+			continue
+		}
+		log.WithField("error", err).Warn("mirror interrupted, retrying")
+		time.Sleep(mirrorRetryDelay)
+	}
+}
+
+func (o *Mirror) check() error {
+	if o.LagIntervalDuration <= 0 {
+		return fmt.Errorf("invalid --lag-interval %s, expected more than 0", o.LagIntervalDuration)
+	}
+	return nil
+}
+
+// copyAll makes the target hold the same keys as the source, and returns the
+// source index it copied.
+func (o *Mirror) copyAll(source, target *etcd.Client) (uint64, error) {
+	log.Info("copying source cluster")
+	response, err := fetchRoot(source)
+	if err != nil {
+		return 0, err
+	}
+
+	current, err := fetchRoot(target)
+	if err != nil {
+		return 0, err
+	}
+	stale := map[string]bool{}
+	backup.Walk(current.Node, func(node *etcd.Node) {
+		if len(node.Key) > 0 {
+			stale[node.Key] = node.Dir
+		}
+	})
+	// The target keeps the keys the source has, unless they are a directory
+	// on one side and a value on the other, and couldn't be written over.
+	backup.Walk(response.Node, func(node *etcd.Node) {
+		if dir, ok := stale[node.Key]; ok && dir == node.Dir {
+			delete(stale, node.Key)
+		}
+	})
+
+	deleted := 0
+	for key := range stale {
+		_, err := target.Delete(key, true)
+		switch {
+		case backup.IsEtcdError(err, backup.EtcdErrKeyNotFound):
+			// Gone with a directory above it.
+		case err != nil:
+			return 0, err
+		default:
+			deleted++
+		}
+	}
+
+	now := time.Now()
+	copied := 0
+	var copyErr error
+	backup.Walk(response.Node, func(node *etcd.Node) {
+		// Values, and directories that would not be created along the way.
+		if copyErr != nil || (node.Dir && len(node.Nodes) > 0) || len(node.Key) == 0 {
+			return
+		}
+		copyErr = o.setNode(target, node, now)
+		copied++
+	})
+	if copyErr != nil {
+		return 0, copyErr
+	}
+
+	log.WithFields(log.Fields{
+		"keys":    copied,
+		"deleted": deleted,
+		"index":   response.EtcdIndex,
+	}).Info("copied source cluster")
+	return response.EtcdIndex, nil
+}
+
+// follow applies the changes of the source after index to the target, until
+// either fails. It returns the last applied index.
+func (o *Mirror) follow(source, target *etcd.Client, index uint64, lag *mirrorLag) (uint64, error) {
+	// The go-etcd client isn't safe for concurrent use once requests fail,
+	// so the watch gets its own.
+	watcher := etcd.NewClient(o.Source)
+	defer watcher.Close()
+
+	receiver := make(chan *etcd.Response)
+	stop := make(chan bool)
+	watchErr := make(chan error, 1)
+	go func() {
+		_, err := watcher.Watch("/", index+1, true, receiver, stop)
+		watchErr <- err
+	}()
+
+	ticker := time.NewTicker(o.LagIntervalDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case response, ok := <-receiver:
+			if !ok {
+				return index, <-watchErr
+			}
+			if err := o.apply(target, response); err != nil {
+				close(stop)
+				for range receiver {
+				}
+				return index, err
+			}
+			index = response.Node.ModifiedIndex
+			lag.applied(index)
+		case <-ticker.C:
+			lag.report(source)
+			o.writeState(target, index)
+		}
+	}
+}
+
+// apply replays a change of the source onto the target.
+func (o *Mirror) apply(target *etcd.Client, response *etcd.Response) error {
+	node := response.Node
+	log.WithFields(log.Fields{
+		"action": response.Action,
+		"key":    node.Key,
+		"index":  node.ModifiedIndex,
+	}).Debug("applying change")
+
+	switch response.Action {
+	case "delete", "compareAndDelete", "expire":
+		_, err := target.Delete(node.Key, true)
+		if backup.IsEtcdError(err, backup.EtcdErrKeyNotFound) {
+			return nil
+		}
+		return err
+	default:
+		return o.setNode(target, node, time.Now())
+	}
+}
+
+// setNode writes a value or a directory with the TTL it has left.
+func (o *Mirror) setNode(target *etcd.Client, node *etcd.Node, now time.Time) error {
+	ttl, expired := backup.RemainingTTL(node.Expiration, now)
+	if expired {
+		return nil
+	}
+
+	if !node.Dir {
+		_, err := target.Set(node.Key, node.Value, ttl)
+		return err
+	}
+	_, err := target.CreateDir(node.Key, ttl)
+	if backup.IsEtcdError(err, backup.EtcdErrNodeExist) {
+		_, err = target.UpdateDir(node.Key, ttl)
+	}
+	return err
+}
+
+// readState returns the last applied index, 0 if there is none.
+func (o *Mirror) readState(target *etcd.Client) (uint64, error) {
+	var data []byte
+	if o.StateFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(o.StateFile); os.IsNotExist(err) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	} else {
+		response, err := target.Get(o.StateKey, false, false)
+		if backup.IsEtcdError(err, backup.EtcdErrKeyNotFound) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		data = []byte(response.Node.Value)
+	}
+
+	var state mirrorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("could not decode mirror state: %v", err)
+	}
+	return state.Index, nil
+}
+
+// writeState records the last applied index. Failing to do so only means
+// replaying more changes after a restart.
+func (o *Mirror) writeState(target *etcd.Client, index uint64) {
+	data, err := json.Marshal(mirrorState{Index: index, Time: time.Now().UTC()})
+	if err != nil {
+		log.WithField("error", err).Warn("could not encode mirror state")
+		return
+	}
+
+	if o.StateFile != "" {
+		err = writeFileAtomic(o.StateFile, 0644, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	} else {
+		_, err = target.Set(o.StateKey, string(data), 0)
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("could not record mirror state")
+	}
+}
+
+// mirrorLag tracks how far the target is behind the source, in indexes and
+// in time since it was last caught up.
+type mirrorLag struct {
+	index    uint64
+	syncedAt time.Time
+}
+
+func (l *mirrorLag) applied(index uint64) {
+	l.index = index
+}
+
+// report compares the applied index with the current index of the source.
+// Changes to hidden keys are never sent to the mirror, but do move the
+// source index, so they count as lag until the next visible change.
+func (l *mirrorLag) report(source *etcd.Client) {
+	response, err := source.Get("/", false, false)
+	if err != nil {
+		log.WithField("error", err).Warn("could not read source index")
+		return
+	}
+
+	behind := uint64(0)
+	if response.EtcdIndex > l.index {
+		behind = response.EtcdIndex - l.index
+	}
+	now := time.Now()
+	if behind == 0 {
+		l.syncedAt = now
+	}
+	lagTime := now.Sub(l.syncedAt)
+
+	appliedVar := new(expvar.Int)
+	appliedVar.Set(int64(l.index))
+	behindVar := new(expvar.Int)
+	behindVar.Set(int64(behind))
+	lagVar := new(expvar.Float)
+	lagVar.Set(lagTime.Seconds())
+	metrics.Set("mirror_applied_index", appliedVar)
+	metrics.Set("mirror_lag_index", behindVar)
+	metrics.Set("mirror_lag_seconds", lagVar)
+
+	log.WithFields(log.Fields{
+		"applied": l.index,
+		"source":  response.EtcdIndex,
+		"behind":  behind,
+		"lag":     lagTime.Truncate(time.Second),
+	}).Info("replication lag")
+}
+
+func init() {
+	mirror.LagInterval = func(dur string) {
+		if pDur, err := time.ParseDuration(dur); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"duration": dur,
+			}).Fatal("could not parse lag interval")
+		} else {
+			mirror.LagIntervalDuration = pDur
+		}
+	}
+
+	parser.AddCommand("mirror",
+		"Mirror a cluster",
+		"Copy every key of the source cluster to the target cluster, then keep applying the changes of the source, resuming from the last applied index after a restart.",
+		&mirror,
+	)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestMirrorCheck(t *testing.T) {
+	for _, tt := range []struct {
+		lag time.Duration
+		ok  bool
+	}{
+		{10 * time.Second, true},
+		{0, false},
+		{-time.Second, false},
+	} {
+		o := Mirror{LagIntervalDuration: tt.lag}
+		if err := o.check(); (err == nil) != tt.ok {
+			t.Errorf("--lag-interval=%s: err = %v, want ok %t", tt.lag, err, tt.ok)
+		}
+	}
+}
+
+func TestMirrorCopyAll(t *testing.T) {
+	source := etcdtest.NewServer()
+	defer source.Close()
+	source.Set("/apps/web/config", `{"port": 8080}`, 0)
+	source.Set("/became/dir/key", "1", 0)
+	source.Set("/became-value", "2", 0)
+
+	target := etcdtest.NewServer()
+	defer target.Close()
+	target.Set("/apps/web/config", `{"port": 9090}`, 0)
+	target.Set("/became/dir", "was a value", 0)
+	target.Set("/became-value/key", "was a directory", 0)
+	target.Set("/gone/key", "3", 0)
+	target.Set("/_etcdbk/mirror", `{"index": 1}`, 0)
+
+	sourceClient := etcd.NewClient(source.Machines())
+	defer sourceClient.Close()
+	targetClient := etcd.NewClient(target.Machines())
+	defer targetClient.Close()
+	if _, err := targetClient.CreateDir("/old/empty", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Twice: the second copy finds nothing to fix.
+	for i := 0; i < 2; i++ {
+		index, err := mirror.copyAll(sourceClient, targetClient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != source.Index() {
+			t.Errorf("copied index %d, want %d", index, source.Index())
+		}
+	}
+
+	want := source.Keys("/")
+	want["/_etcdbk/mirror"] = `{"index": 1}`
+	if got := target.Keys("/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("target holds %v, want %v", got, want)
+	}
+	for _, key := range []string{"/gone", "/old"} {
+		if _, err := targetClient.Get(key, false, false); err == nil {
+			t.Errorf("directory %s missing from the source still in the target", key)
+		}
+	}
+}
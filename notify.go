@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Events reported by notifications.
+const (
+	eventSuccess = "success"
+	eventFailure = "failure"
+	eventStale   = "stale"
+)
+
+// backupEvent is handed to notification templates, and sent as JSON to
+// webhooks and commands.
+type backupEvent struct {
+	Event    string        `json:"event"`
+	Cluster  string        `json:"cluster"`
+	Hostname string        `json:"hostname"`
+	Time     time.Time     `json:"time"`
+	Error    string        `json:"error,omitempty"`
+	Status   *backupStatus `json:"status,omitempty"`
+}
+
+type NotifyOptions struct {
+	NotifyOn              []string `long:"notify-on" env:"NOTIFY_ON" env-delim:"," default:"failure" default:"stale" description:"Events to notify about: success, failure, stale"`
+	NotifyWebhook         []string `long:"notify-webhook" env:"NOTIFY_WEBHOOK" env-delim:"," description:"URL to POST events to, as JSON unless --notify-webhook-template is set"`
+	NotifyWebhookTemplate string   `long:"notify-webhook-template" env:"NOTIFY_WEBHOOK_TEMPLATE" description:"Go template for webhook request bodies"`
+	NotifySlack           []string `long:"notify-slack" env:"NOTIFY_SLACK" env-delim:"," description:"Slack-compatible incoming webhook URL to POST a message to"`
+	NotifyMessage         string   `long:"notify-message" env:"NOTIFY_MESSAGE" default:"etcdbk backup of {{.Cluster}}: {{.Event}}{{with .Error}} ({{.}}){{end}}" description:"Go template for Slack messages"`
+	NotifyExec            []string `long:"notify-exec" env:"NOTIFY_EXEC" description:"Command to run through sh -c, with the event on stdin, as JSON unless --notify-exec-template is set"`
+	NotifyExecTemplate    string   `long:"notify-exec-template" env:"NOTIFY_EXEC_TEMPLATE" description:"Go template for the stdin of notification commands"`
+	NotifyRetries         int      `long:"notify-retries" env:"NOTIFY_RETRIES" default:"3" description:"How many times to retry a failed notification"`
+}
+
+// notifier delivers a single notification.
+type notifier interface {
+	Notify(event backupEvent) error
+}
+
+// Delay before the first retry of a failed notification, doubled for every
+// further one.
+var notifyRetryDelay = time.Second
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// pendingNotifications counts the notifications still being delivered, and
+// closes idle when none are left.
+var pendingNotifications struct {
+	sync.Mutex
+	count int
+	idle  chan struct{}
+}
+
+func notificationStarted() {
+	pendingNotifications.Lock()
+	defer pendingNotifications.Unlock()
+	if pendingNotifications.count == 0 {
+		pendingNotifications.idle = make(chan struct{})
+	}
+	pendingNotifications.count++
+}
+
+func notificationDone() {
+	pendingNotifications.Lock()
+	defer pendingNotifications.Unlock()
+	pendingNotifications.count--
+	if pendingNotifications.count == 0 {
+		close(pendingNotifications.idle)
+	}
+}
+
+// notificationsDone is closed once the notifications pending when it is
+// called have been delivered or given up on.
+func notificationsDone() <-chan struct{} {
+	pendingNotifications.Lock()
+	defer pendingNotifications.Unlock()
+	if pendingNotifications.count == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return pendingNotifications.idle
+}
+
+func (o *NotifyOptions) checkNotifyOptions() error {
+	for _, event := range o.NotifyOn {
+		switch event {
+		case eventSuccess, eventFailure, eventStale:
+		default:
+			return fmt.Errorf("unknown notification event %q, expected success, failure or stale", event)
+		}
+	}
+
+	_, err := o.notifiers()
+	return err
+}
+
+func (o *NotifyOptions) notifiers() ([]notifier, error) {
+	var notifiers []notifier
+
+	body, err := parseOptionalTemplate("webhook", o.NotifyWebhookTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+	for _, hook := range o.NotifyWebhook {
+		notifiers = append(notifiers, webhookNotifier{URL: hook, Body: body})
+	}
+
+	message, err := template.New("message").Parse(o.NotifyMessage)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification message template: %v", err)
+	}
+	for _, hook := range o.NotifySlack {
+		notifiers = append(notifiers, slackNotifier{URL: hook, Message: message})
+	}
+
+	input, err := parseOptionalTemplate("exec", o.NotifyExecTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec template: %v", err)
+	}
+	for _, command := range o.NotifyExec {
+		notifiers = append(notifiers, execNotifier{Command: command, Input: input})
+	}
+
+	return notifiers, nil
+}
+
+// parseOptionalTemplate parses text, unless it is empty.
+func parseOptionalTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Parse(text)
+}
+
+// renderEvent renders event through tmpl, or as JSON if there is none.
+func renderEvent(tmpl *template.Template, event backupEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	if tmpl != nil {
+		if err := tmpl.Execute(&buf, event); err != nil {
+			return nil, err
+		}
+	} else if err := json.NewEncoder(&buf).Encode(event); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// notify sends event to every notifier in the background, if notifications
+// are wanted for it, so that a slow or dead receiver doesn't hold up
+// backups. Failures are logged, never returned; notificationsDone tells when
+// deliveries are over.
+func (o *NotifyOptions) notify(event backupEvent) {
+	wanted := false
+	for _, e := range o.NotifyOn {
+		wanted = wanted || e == event.Event
+	}
+	if !wanted {
+		return
+	}
+
+	notifiers, err := o.notifiers()
+	if err != nil {
+		log.WithField("error", err).Warn("could not set up notifications")
+		return
+	}
+
+	if event.Hostname == "" {
+		event.Hostname, _ = os.Hostname()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	// The options may be reloaded while delivering.
+	retries := o.NotifyRetries
+	for _, n := range notifiers {
+		notificationStarted()
+		go func(n notifier) {
+			defer notificationDone()
+			deliver(n, event, retries)
+		}(n)
+	}
+}
+
+// deliver sends event through n, retrying up to retries times.
+func deliver(n notifier, event backupEvent, retries int) {
+	delay := notifyRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := n.Notify(event)
+		if err == nil {
+			return
+		}
+
+		fields := log.Fields{
+			"error":    err,
+			"notifier": n,
+			"event":    event.Event,
+		}
+		if attempt >= retries {
+			log.WithFields(fields).Error("could not send notification")
+			return
+		}
+		log.WithFields(fields).Warn("could not send notification, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// webhookNotifier POSTs the event as JSON, or rendered through Body.
+type webhookNotifier struct {
+	URL  string
+	Body *template.Template
+}
+
+func (n webhookNotifier) Notify(event backupEvent) error {
+	body, err := renderEvent(n.Body, event)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.URL, body)
+}
+
+func (n webhookNotifier) String() string {
+	return "webhook " + redactURL(n.URL)
+}
+
+// slackNotifier POSTs a message in the format of Slack incoming webhooks,
+// which many chat services accept.
+type slackNotifier struct {
+	URL     string
+	Message *template.Template
+}
+
+func (n slackNotifier) Notify(event backupEvent) error {
+	var text bytes.Buffer
+	if err := n.Message.Execute(&text, event); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text.String()})
+	if err != nil {
+		return err
+	}
+	return postJSON(n.URL, body)
+}
+
+func (n slackNotifier) String() string {
+	return "slack " + redactURL(n.URL)
+}
+
+// redactURL cuts a webhook URL down to its scheme and host: the path and
+// query of webhooks usually hold their secret token.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "(invalid URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// postJSON POSTs body to the webhook at rawURL. Errors only name its host.
+func postJSON(rawURL string, body []byte) error {
+	resp, err := notifyClient.Post(rawURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = redactURL(rawURL)
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", redactURL(rawURL), resp.Status)
+	}
+	return nil
+}
+
+// execNotifier runs a shell command with the event on stdin, as JSON or
+// rendered through Input.
+type execNotifier struct {
+	Command string
+	Input   *template.Template
+}
+
+func (n execNotifier) Notify(event backupEvent) error {
+	input, err := renderEvent(n.Input, event)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", n.Command)
+	cmd.Stdin = bytes.NewReader(input)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (n execNotifier) String() string {
+	return "exec " + n.Command
+}
+
+// staleWatch raises a stale event when no backup succeeded for a while, once
+// per dry spell.
+type staleWatch struct {
+	after time.Duration
+	clock clock
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+	reported    bool
+}
+
+func newStaleWatch(after time.Duration, clock clock) *staleWatch {
+	return &staleWatch{
+		after:       after,
+		clock:       clock,
+		lastSuccess: clock.Now(),
+	}
+}
+
+func (w *staleWatch) Success() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastSuccess = w.clock.Now()
+	w.reported = false
+}
+
+// Run calls stale whenever the last success, or the start of the watch, is
+// more than the configured duration ago, until stop is closed.
+func (w *staleWatch) Run(stop <-chan struct{}, stale func(lastSuccess time.Time)) {
+	for {
+		w.mu.Lock()
+		due := w.lastSuccess.Add(w.after)
+		wait := due.Sub(w.clock.Now())
+		report := wait <= 0 && !w.reported
+		if report {
+			w.reported = true
+		}
+		last := w.lastSuccess
+		w.mu.Unlock()
+
+		if report {
+			stale(last)
+		}
+		if wait <= 0 {
+			wait = w.after
+		}
+		select {
+		case <-w.clock.After(wait):
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// receiver records the bodies POSTed to it, answering with the statuses in
+// fail first, then 200.
+type receiver struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	bodies []string
+	fail   []int
+}
+
+func newReceiver(t *testing.T, fail ...int) *receiver {
+	r := &receiver{fail: fail}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.bodies = append(r.bodies, string(body))
+		if len(r.fail) > 0 {
+			w.WriteHeader(r.fail[0])
+			r.fail = r.fail[1:]
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bodies...)
+}
+
+// notifyNow sends event through o and waits for it to be delivered.
+func notifyNow(t *testing.T, o NotifyOptions, event backupEvent) {
+	t.Helper()
+	if err := o.checkNotifyOptions(); err != nil {
+		t.Fatal(err)
+	}
+	o.notify(event)
+	select {
+	case <-notificationsDone():
+	case <-time.After(5 * time.Second):
+		t.Fatal("notifications still being sent")
+	}
+}
+
+var testEvent = backupEvent{
+	Event:    eventFailure,
+	Cluster:  "prod",
+	Hostname: "backup-1",
+	Time:     time.Date(2016, 2, 11, 2, 0, 5, 0, time.UTC),
+	Error:    "Access Denied",
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name: "JSON",
+			want: `{"event":"failure","cluster":"prod","hostname":"backup-1","time":"2016-02-11T02:00:05Z","error":"Access Denied"}` + "\n",
+		},
+		{
+			name:     "template",
+			template: `{"summary": "{{.Cluster}} {{.Event}}: {{.Error}}"}`,
+			want:     `{"summary": "prod failure: Access Denied"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReceiver(t)
+			notifyNow(t, NotifyOptions{
+				NotifyOn:              []string{eventFailure},
+				NotifyWebhook:         []string{r.URL},
+				NotifyWebhookTemplate: tt.template,
+			}, testEvent)
+
+			if got := r.received(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifySlack(t *testing.T) {
+	r := newReceiver(t)
+	notifyNow(t, NotifyOptions{
+		NotifyOn:      []string{eventFailure},
+		NotifySlack:   []string{r.URL},
+		NotifyMessage: "etcdbk backup of {{.Cluster}}: {{.Event}}{{with .Error}} ({{.}}){{end}}",
+	}, testEvent)
+
+	got := r.received()
+	if len(got) != 1 {
+		t.Fatalf("received %q, want one message", got)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(got[0]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if want := "etcdbk backup of prod: failure (Access Denied)"; len(payload) != 1 || payload["text"] != want {
+		t.Errorf("payload = %v, want only text %q", payload, want)
+	}
+}
+
+func TestNotifyOn(t *testing.T) {
+	r := newReceiver(t)
+	o := NotifyOptions{NotifyOn: []string{eventFailure, eventStale}, NotifyWebhook: []string{r.URL}}
+	notifyNow(t, o, backupEvent{Event: eventSuccess, Cluster: "prod"})
+	if got := r.received(); len(got) != 0 {
+		t.Errorf("received %q for an unwanted event", got)
+	}
+
+	o.NotifyOn = []string{"sucess"}
+	if err := o.checkNotifyOptions(); err == nil {
+		t.Error("unknown event accepted")
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	defer func(delay time.Duration) { notifyRetryDelay = delay }(notifyRetryDelay)
+	notifyRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name     string
+		fail     []int
+		attempts int
+	}{
+		{name: "delivered", attempts: 1},
+		{name: "delivered on retry", fail: []int{500, 503}, attempts: 3},
+		{name: "given up", fail: []int{500, 500, 500, 500, 500}, attempts: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReceiver(t, tt.fail...)
+			start := time.Now()
+			notifyNow(t, NotifyOptions{
+				NotifyOn:      []string{eventFailure},
+				NotifyWebhook: []string{r.URL},
+				NotifyRetries: 3,
+			}, testEvent)
+
+			if got := len(r.received()); got != tt.attempts {
+				t.Errorf("%d attempts, want %d", got, tt.attempts)
+			}
+			// 1ms, 2ms, 4ms...
+			if backoff := time.Duration(1<<uint(tt.attempts-1)-1) * time.Millisecond; time.Since(start) < backoff {
+				t.Errorf("delivered within %s, want a backoff of at least %s", time.Since(start), backoff)
+			}
+		})
+	}
+}
+
+func TestNotifyAsync(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+
+	o := NotifyOptions{NotifyOn: []string{eventFailure}, NotifyWebhook: []string{srv.URL}}
+	returned := make(chan struct{})
+	go func() {
+		o.notify(testEvent)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify waited for the receiver")
+	}
+
+	done := notificationsDone()
+	select {
+	case <-done:
+		t.Error("notifications done before delivery")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(unblock)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("notification not delivered")
+	}
+}
+
+func TestNotifyExec(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name: "JSON",
+			want: `{"event":"failure","cluster":"prod","hostname":"backup-1","time":"2016-02-11T02:00:05Z","error":"Access Denied"}` + "\n",
+		},
+		{
+			name:     "template",
+			template: "{{.Cluster}}\t{{.Event}}\t{{.Error}}",
+			want:     "prod\tfailure\tAccess Denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "event")
+			notifyNow(t, NotifyOptions{
+				NotifyOn:           []string{eventFailure},
+				NotifyExec:         []string{"cat > '" + out + "'"},
+				NotifyExecTemplate: tt.template,
+			}, testEvent)
+
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("stdin = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyExecFailure(t *testing.T) {
+	err := execNotifier{Command: "echo no space left >&2; exit 3"}.Notify(testEvent)
+	if err == nil || err.Error() != "exit status 3: no space left" {
+		t.Errorf("err = %v, want the exit status and output", err)
+	}
+}
+
+func TestNotifyInvalidTemplates(t *testing.T) {
+	for _, o := range []NotifyOptions{
+		{NotifyWebhookTemplate: "{{.Cluster"},
+		{NotifyMessage: "{{end}}"},
+		{NotifyExecTemplate: "{{if}}"},
+	} {
+		if err := o.checkNotifyOptions(); err == nil {
+			t.Errorf("%+v accepted", o)
+		}
+	}
+}
+
+func TestNotifierHidesTokens(t *testing.T) {
+	const token = "T0000/B0000/XXXXXXXXXXXX"
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, n := range []notifier{
+		webhookNotifier{URL: failing.URL + "/hooks/" + token},
+		slackNotifier{URL: closed.URL + "/services/" + token, Message: template.Must(template.New("").Parse("stale"))},
+	} {
+		err := n.Notify(testEvent)
+		if err == nil {
+			t.Fatalf("%s: delivered", n)
+		}
+		for what, text := range map[string]string{"name": fmt.Sprint(n), "error": err.Error()} {
+			if strings.Contains(text, token) {
+				t.Errorf("%s %q holds the token", what, text)
+			}
+		}
+	}
+}
+
+func TestStaleWatch(t *testing.T) {
+	clock := newFakeClock("2016-02-11T02:00:00Z")
+	w := newStaleWatch(time.Hour, clock)
+	reported := make(chan time.Time, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.Run(stop, func(lastSuccess time.Time) { reported <- lastSuccess })
+		close(done)
+	}()
+
+	clock.blockUntil(t, 1)
+	clock.Advance(time.Hour)
+	select {
+	case last := <-reported:
+		if want := newFakeClock("2016-02-11T02:00:00Z").Now(); !last.Equal(want) {
+			t.Errorf("reported stale since %s, want %s", last, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stale report")
+	}
+
+	// Reported once per dry spell.
+	clock.blockUntil(t, 1)
+	clock.Advance(time.Hour)
+	clock.blockUntil(t, 1)
+	if len(reported) != 0 {
+		t.Error("reported twice")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still running after stop")
+	}
+}
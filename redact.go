@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/christian-blades-cb/etcdbk/backup"
+)
+
+type RedactOptions struct {
+	Redact        []string `long:"redact" env:"REDACT" env-delim:"," description:"Glob of keys whose values are redacted, e.g. /app/*/password. A glob without a slash matches the last element of the key"`
+	RedactBuiltin bool     `long:"redact-builtin" env:"REDACT_BUILTIN" description:"Also redact common secrets: PEM blocks, AWS keys, and keys named like passwords, secrets or tokens"`
+	RedactMode    string   `long:"redact-mode" env:"REDACT_MODE" default:"marker" description:"Replace redacted values with the marker, or with a salted hash: marker, hash"`
+	RedactMarker  string   `long:"redact-marker" env:"REDACT_MARKER" default:"REDACTED" description:"Value that replaces redacted values"`
+	RedactSalt    string   `long:"redact-salt" env:"REDACT_SALT" description:"Salt for --redact-mode=hash, random for every run if not set"`
+}
+
+func (o *RedactOptions) redaction() backup.Redaction {
+	return backup.Redaction{
+		Globs:   o.Redact,
+		Builtin: o.RedactBuiltin,
+		Mode:    o.RedactMode,
+		Marker:  o.RedactMarker,
+		Salt:    o.RedactSalt,
+	}
+}
+
+// newRedactor returns nil when no redaction was asked for.
+func (o *RedactOptions) newRedactor() (*backup.Redactor, error) {
+	return backup.NewRedactor(o.redaction())
+}
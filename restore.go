@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+type Restore struct {
+	Archive    string `long:"archive" short:"a" env:"RESTORE_ARCHIVE" default:"-" description:"Archive to restore, - for STDIN"`
+	Mode       string `long:"mode" env:"RESTORE_MODE" default:"merge" description:"What to do with existing keys: merge (set every key), skip-existing, overwrite-if-unchanged (compare-and-swap against the index read before restoring), replace (delete the target prefix first)"`
+	Force      bool   `long:"force" description:"Restore a redacted archive, writing its placeholders over real values"`
+	DryRun     bool   `long:"dry-run" description:"Print what the restore would do, without writing anything"`
+	PlanFormat string `long:"plan-format" env:"RESTORE_PLAN_FORMAT" default:"text" description:"Format of the --dry-run plan: text, json"`
+	PlanOut    string `long:"plan-out" env:"RESTORE_PLAN_OUT" description:"With --dry-run, also save the plan as JSON to this file"`
+	Plan       string `long:"plan" env:"RESTORE_PLAN" description:"Apply a plan saved by --plan-out instead of reading an archive, aborting if any of its keys changed since"`
+
+	Only       []string `long:"only" env:"RESTORE_ONLY" env-delim:"," description:"Only restore the archived keys below this prefix"`
+	FromPrefix string   `long:"from-prefix" env:"RESTORE_FROM_PREFIX" default:"/" description:"Only restore the archived keys below this prefix, moving them to --to-prefix"`
+	ToPrefix   string   `long:"to-prefix" env:"RESTORE_TO_PREFIX" default:"/" description:"Prefix to restore the keys below --from-prefix to"`
+	Rewrite    []string `long:"rewrite" env:"RESTORE_REWRITE" env-delim:"," description:"Rewrite restored keys with REGEXP=>REPLACEMENT, after moving them to --to-prefix. $1 and so on refer to groups"`
+
+	FromS3 string     `long:"from-s3" env:"RESTORE_FROM_S3" description:"Restore an archive of --cluster-name from --aws-bucket instead of --archive: latest, or the one taken at this etcd index"`
+	S3     S3Location `group:"S3 Options"`
+}
+
+var restore Restore
+
+func (o *Restore) Execute(args []string) error {
+	switch o.PlanFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown plan format %q, expected text or json", o.PlanFormat)
+	}
+	if o.Plan != "" && o.DryRun {
+		return fmt.Errorf("--plan applies a plan, it can't be combined with --dry-run")
+	}
+	if o.FromS3 != "" {
+		if o.Plan != "" || o.Archive != "-" {
+			return fmt.Errorf("--from-s3 reads the archive from S3, it can't be combined with --archive or --plan")
+		}
+		if err := o.S3.check(); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	cfg := backup.RestoreConfig{
+		Cluster:       cluster(),
+		Mode:          o.Mode,
+		AllowRedacted: o.Force,
+		Remap: backup.Remap{
+			Only:       o.Only,
+			FromPrefix: o.FromPrefix,
+			ToPrefix:   o.ToPrefix,
+			Rewrite:    o.Rewrite,
+		},
+		Report: os.Stdout,
+	}
+
+	if o.Plan != "" {
+		plan, err := readRestorePlan(o.Plan)
+		if err != nil {
+			return err
+		}
+		_, err = backup.ApplyPlan(ctx, cfg, plan)
+		return err
+	}
+
+	var in io.ReadCloser
+	var err error
+	if o.FromS3 != "" {
+		in, err = o.S3.openArchive(o.FromS3)
+	} else {
+		in, err = openArchive(o.Archive)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read archive: %v", err)
+	}
+	defer in.Close()
+
+	if o.DryRun {
+		plan, err := backup.PlanRestore(ctx, cfg, in)
+		if err != nil {
+			return restoreError(err)
+		}
+		return o.printPlan(plan)
+	}
+	_, err = backup.Restore(ctx, cfg, in)
+	return restoreError(err)
+}
+
+func restoreError(err error) error {
+	if err == backup.ErrRedacted {
+		return fmt.Errorf("%v; use --force to restore it anyway", err)
+	}
+	return err
+}
+
+func (o *Restore) printPlan(plan *backup.Plan) error {
+	if o.PlanOut != "" {
+		if err := writeRestorePlan(o.PlanOut, plan); err != nil {
+			return fmt.Errorf("could not write plan: %v", err)
+		}
+		log.WithField("filepath", o.PlanOut).Info("wrote restore plan")
+	}
+
+	if o.PlanFormat == "json" {
+		return plan.WriteJSON(os.Stdout)
+	}
+	plan.WriteText(os.Stdout)
+	return nil
+}
+
+// openArchive opens the archive at path, - being STDIN.
+func openArchive(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// openArchive opens the archive of the cluster in the bucket that which
+// names: latest, or the one taken at an etcd index, as recorded in its
+// metadata.
+func (l *S3Location) openArchive(which string) (io.ReadCloser, error) {
+	var index string
+	if which != "latest" {
+		if _, err := strconv.ParseUint(which, 10, 64); err != nil {
+			return nil, fmt.Errorf("expected latest or an etcd index, not %q", which)
+		}
+		index = which
+	}
+
+	bucket, err := l.bucket()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := l.archives(bucket)
+	if err != nil {
+		return nil, err
+	}
+	sortRecent(keys)
+
+	for _, key := range keys {
+		if index != "" {
+			resp, err := bucket.Head(key.Key, nil)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			if resp.Header.Get("x-amz-meta-"+metaEtcdIndex) != index {
+				continue
+			}
+		}
+
+		log.WithField("key", key.Key).Info("restoring archive from bucket")
+		return bucket.GetReader(key.Key)
+	}
+
+	if index != "" {
+		return nil, fmt.Errorf("no archive of cluster %q taken at etcd index %s in bucket %s", l.ClusterName, index, l.AwsBucket)
+	}
+	return nil, fmt.Errorf("no archive of cluster %q in bucket %s", l.ClusterName, l.AwsBucket)
+}
+
+// readArchive reads the archive at path, - being STDIN.
+func readArchive(path string) (*etcd.Node, backup.Manifest, error) {
+	in, err := openArchive(path)
+	if err != nil {
+		return nil, backup.Manifest{}, err
+	}
+	defer in.Close()
+
+	return backup.ReadArchive(in)
+}
+
+func readRestorePlan(path string) (*backup.Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return backup.ReadPlan(f)
+}
+
+// writeRestorePlan saves plan as JSON for a later --plan. The plan holds
+// every value of the archive, so it is only readable by its owner.
+func writeRestorePlan(path string, plan *backup.Plan) error {
+	return writeFileAtomic(path, os.FileMode(0600), plan.WriteJSON)
+}
+
+func init() {
+	parser.AddCommand("restore",
+		"Restore from an archive",
+		"Write the keys of an archive back into the cluster, reporting what happened to every key.",
+		&restore,
+	)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/christian-blades-cb/etcdbk/backup"
+	"github.com/christian-blades-cb/etcdbk/etcdtest"
+)
+
+// testLocation is where tests keep the archives of cluster "prod" on srv.
+func testLocation(endpoint string) S3Location {
+	return S3Location{
+		ClusterName:   "prod",
+		KeyTemplate:   "etcd/{{.ClusterName}}/{{.EtcdIndex}}.{{.Ext}}",
+		AwsAccessKey:  testAuth.AccessKey,
+		AwsSecretKey:  testAuth.SecretKey,
+		AwsS3Endpoint: endpoint,
+		AwsBucket:     testBucket,
+		AwsRegion:     "us-east-1",
+		AwsSignature:  "v2",
+	}
+}
+
+// uploadSnapshot uploads a snapshot of etcd under the key of its etcd index,
+// and returns that index.
+func uploadSnapshot(t *testing.T, l S3Location, etcd *etcdtest.Server) uint64 {
+	t.Helper()
+	var buf bytes.Buffer
+	m, err := backup.Snapshot(context.Background(), backup.SnapshotConfig{
+		Cluster: backup.Cluster{Machines: etcd.Machines()},
+	}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := l.awsCredentials().Auth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := parseKeyTemplate(l.KeyTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := renderKey(tmpl, KeyFields{ClusterName: l.ClusterName, EtcdIndex: m.EtcdIndex, Ext: archiveExt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3w := (&ToS3{S3Location: l}).s3Writer(auth)
+	if err := s3w.WriteToS3(key, buf.Bytes(), map[string]string{metaEtcdIndex: strconv.FormatUint(m.EtcdIndex, 10)}); err != nil {
+		t.Fatal(err)
+	}
+	return m.EtcdIndex
+}
+
+func TestRestoreFromS3(t *testing.T) {
+	srv := newS3Server(t)
+	l := testLocation(srv.URL())
+
+	source := etcdtest.NewServer()
+	defer source.Close()
+	source.Set("/app/config", "v1", 0)
+	first := uploadSnapshot(t, l, source)
+	source.Set("/app/config", "v2", 0)
+	source.Set("/app/hosts/web-1", "10.0.0.1", 0)
+	uploadSnapshot(t, l, source)
+
+	tests := []struct {
+		fromS3 string
+		want   map[string]string
+	}{
+		{
+			fromS3: "latest",
+			want:   map[string]string{"/app/config": "v2", "/app/hosts/web-1": "10.0.0.1"},
+		},
+		{
+			fromS3: strconv.FormatUint(first, 10),
+			want:   map[string]string{"/app/config": "v1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fromS3, func(t *testing.T) {
+			target := etcdtest.NewServer()
+			defer target.Close()
+			opts.EtcdMachines = target.Machines()
+
+			o := Restore{Archive: "-", PlanFormat: "text", FromPrefix: "/", ToPrefix: "/", FromS3: tt.fromS3, S3: l}
+			if err := o.Execute(nil); err != nil {
+				t.Fatal(err)
+			}
+			got := target.Keys("/")
+			if len(got) != len(tt.want) {
+				t.Errorf("restored %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreFromS3Errors(t *testing.T) {
+	srv := newS3Server(t)
+	l := testLocation(srv.URL())
+	source := etcdtest.NewServer()
+	defer source.Close()
+	source.Set("/app/config", "v1", 0)
+	uploadSnapshot(t, l, source)
+
+	target := etcdtest.NewServer()
+	defer target.Close()
+	opts.EtcdMachines = target.Machines()
+
+	tests := []struct {
+		name string
+		o    Restore
+	}{
+		{name: "unknown index", o: Restore{Archive: "-", PlanFormat: "text", FromS3: "999999", S3: l}},
+		{name: "neither latest nor an index", o: Restore{Archive: "-", PlanFormat: "text", FromS3: "newest", S3: l}},
+		{name: "other cluster", o: Restore{Archive: "-", PlanFormat: "text", FromS3: "latest", S3: func() S3Location {
+			other := l
+			other.ClusterName = "staging"
+			return other
+		}()}},
+		{name: "with --archive", o: Restore{Archive: "backup.tar.gz", PlanFormat: "text", FromS3: "latest", S3: l}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.o.Execute(nil); err == nil {
+				t.Error("expected an error")
+			}
+			if keys := target.Keys("/"); len(keys) != 0 {
+				t.Errorf("restored %v anyway", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/goamz/goamz/s3"
+	"sort"
+)
+
+// archives lists the archives of the cluster in bucket, i.e. the objects
+// the key template could have named for it, in key order. Unless the
+// template gives the cluster name a path element of its own, keys of
+// other clusters could match as well, so only the archives whose metadata
+// names the cluster are listed then.
+func (l *S3Location) archives(bucket objectStore) ([]s3.Key, error) {
+	tmpl, err := parseKeyTemplate(l.KeyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	prefix, pattern, own, err := keyMatcher(tmpl, l.ClusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []s3.Key
+	marker := ""
+	for {
+		result, err := bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range result.Contents {
+			marker = key.Key
+			if !pattern.MatchString(key.Key) {
+				continue
+			}
+			if !own {
+				cluster, err := archiveCluster(bucket, key.Key)
+				if err != nil {
+					return nil, err
+				}
+				if cluster != l.ClusterName {
+					log.WithFields(log.Fields{
+						"key":     key.Key,
+						"cluster": cluster,
+					}).Debug("skipping archive of another cluster")
+					continue
+				}
+			}
+			keys = append(keys, key)
+		}
+
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// archiveCluster returns the cluster the metadata of the archive at key
+// names, empty for archives uploaded before it was recorded.
+func archiveCluster(bucket objectStore, key string) (string, error) {
+	resp, err := bucket.Head(key, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("x-amz-meta-" + metaCluster), nil
+}
+
+// prune deletes the archives of the cluster but the --keep most recent
+// ones, and returns the deleted keys.
+func (o *ToS3) prune(s3w S3Writer) ([]string, error) {
+	bucket, err := s3w.bucket()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := o.archives(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) <= o.Keep {
+		return nil, nil
+	}
+
+	sortRecent(keys)
+	var deleted []string
+	for _, key := range keys[o.Keep:] {
+		if err := bucket.Del(key.Key); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, key.Key)
+	}
+	return deleted, nil
+}
+
+// sortRecent sorts archives most recent first. LastModified is ISO 8601,
+// which sorts as text, and only to the second, so the key breaks ties.
+func sortRecent(keys []s3.Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].LastModified != keys[j].LastModified {
+			return keys[i].LastModified > keys[j].LastModified
+		}
+		return keys[i].Key > keys[j].Key
+	})
+}
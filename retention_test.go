@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type testArchive struct {
+	key, cluster string
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		// archives are uploaded in order, with the cluster in their
+		// metadata unless it is empty, as done before it was recorded.
+		archives []testArchive
+		want     []string
+	}{
+		{
+			name:     "cluster name of its own",
+			template: "etcd/{{.ClusterName}}/{{.EtcdIndex}}.{{.Ext}}",
+			archives: []testArchive{
+				{"etcd/prod/101.tar.gz", "prod"},
+				{"etcd/prod/102.tar.gz", ""},
+				{"etcd/prod/103.tar.gz", "prod"},
+				{"etcd/prod/104.tar.gz", "prod"},
+				{"etcd/prod-eu/105.tar.gz", "prod-eu"},
+			},
+			want: []string{"etcd/prod-eu/105.tar.gz", "etcd/prod/103.tar.gz", "etcd/prod/104.tar.gz"},
+		},
+		{
+			name:     "cluster name shared with another",
+			template: "{{.ClusterName}}-{{.Hostname}}-{{.EtcdIndex}}.{{.Ext}}",
+			archives: []testArchive{
+				{"prod-backup-101.tar.gz", "prod"},
+				{"prod-backup-102.tar.gz", ""},
+				{"prod-backup-103.tar.gz", "prod"},
+				{"prod-backup-104.tar.gz", "prod"},
+				{"prod-eu-backup-105.tar.gz", "prod-eu"},
+				{"prod-eu-backup-106.tar.gz", "prod-eu"},
+			},
+			// Neither the other cluster's nor the unknown archive goes.
+			want: []string{"prod-backup-102.tar.gz", "prod-backup-103.tar.gz", "prod-backup-104.tar.gz", "prod-eu-backup-105.tar.gz", "prod-eu-backup-106.tar.gz"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newS3Server(t)
+			l := testLocation(srv.URL())
+			l.KeyTemplate = tt.template
+			o := &ToS3{S3Location: l, Keep: 2}
+			s3w := o.s3Writer(testAuth)
+
+			for _, a := range tt.archives {
+				meta := map[string]string{}
+				if a.cluster != "" {
+					meta[metaCluster] = a.cluster
+				}
+				if err := s3w.WriteToS3(a.key, []byte("archive"), meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deleted, err := o.prune(s3w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucket, err := s3w.bucket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			list, err := bucket.List("", "", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var left []string
+			for _, key := range list.Contents {
+				left = append(left, key.Key)
+			}
+			if !reflect.DeepEqual(left, tt.want) {
+				t.Errorf("left %q after deleting %q, want %q", left, deleted, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnchangedOtherCluster(t *testing.T) {
+	o := &ToS3{S3Location: S3Location{ClusterName: "prod"}}
+	for _, tt := range []struct {
+		cluster   string
+		unchanged bool
+	}{
+		{"prod", true},
+		// Recorded before statuses named their cluster.
+		{"", true},
+		{"staging", false},
+	} {
+		t.Run(fmt.Sprintf("status of %q", tt.cluster), func(t *testing.T) {
+			o.last = &backupStatus{Cluster: tt.cluster, Destination: "s3://etcdbackups/prod-42.tar.gz", EtcdIndex: 42}
+			if _, unchanged := o.unchanged(statusStore{log: log.NewEntry(log.StandardLogger())}, 42, ""); unchanged != tt.unchanged {
+				t.Errorf("unchanged = %t, want %t", unchanged, tt.unchanged)
+			}
+		})
+	}
+}
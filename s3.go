@@ -3,96 +3,313 @@ package main
 import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/christian-blades-cb/etcdbk/backup"
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
-	"sync"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
-type ToS3 struct {
+// S3Location is where the archives of a cluster are kept in S3, and how to
+// reach them.
+type S3Location struct {
 	ClusterName string `long:"cluster-name" short:"n" default:"etcd-cluster" env:"CLUSTER_NAME" description:"Cluster name to use in naming the file in the S3 Bucket"`
+	KeyTemplate string `long:"key-template" env:"KEY_TEMPLATE" default:"{{.ClusterName}}-{{.Timestamp}}.{{.Ext}}" description:"Go template for the object key. Fields: ClusterName, Time, Timestamp, EtcdIndex, Hostname, Ext"`
+
+	AwsAccessKey    string `long:"aws-access" env:"AWS_ACCESS_KEY_ID" description:"Access key of an IAM user with write access to the given bucket"`
+	AwsSecretKey    string `long:"aws-secret" env:"AWS_SECRET_ACCESS_KEY" description:"Secret key of an IAM user with write access to the given bucket"`
+	AwsSessionToken string `long:"aws-session-token" env:"AWS_SESSION_TOKEN" description:"Session token accompanying temporary access and secret keys"`
+	AwsProfile      string `long:"aws-profile" env:"AWS_PROFILE" description:"Profile to read from the shared credentials file when no keys are given"`
+	AwsS3Endpoint   string `long:"s3-endpoint" env:"AWS_S3_ENDPOINT" description:"AWS S3 endpoint, derived from the region if not set. See http://goo.gl/OG2Nkv"`
+	AwsBucket       string `long:"aws-bucket" env:"AWS_S3_BUCKET" description:"Bucket in which to place the archive."`
+	AwsRegion       string `long:"s3-region" env:"AWS_REGION" default:"us-east-1" description:"Region in which the bucket lives"`
+	AwsSignature    string `long:"s3-signature" env:"AWS_S3_SIGNATURE" default:"v2" description:"Request signing version, v2 or v4"`
+	AwsVirtualHost  bool   `long:"s3-virtual-host" env:"AWS_S3_VIRTUAL_HOST" description:"Address the bucket in the hostname of the region endpoint instead of the request path. Not done with --s3-endpoint, nor for bucket names with dots"`
 
-	AwsAccessKey  string `long:"aws-access" env:"AWS_ACCESS_KEY_ID" description:"Access key of an IAM user with write access to the given bucket"`
-	AwsSecretKey  string `long:"aws-secret" env:"AWS_SECRET_ACCESS_KEY" description:"Secret key of an IAM user with write access to the given bucket"`
-	AwsS3Endpoint string `long:"s3-endpoint" env:"AWS_S3_ENDPOINT" default:"https://s3.amazonaws.com" description:"AWS S3 endpoint. See http://goo.gl/OG2Nkv"`
-	AwsBucket     string `long:"aws-bucket" env:"AWS_S3_BUCKET" description:"Bucket in which to place the archive."`
+	credentials *credentialChain
+}
+
+type ToS3 struct {
+	S3Location
+
+	AwsACL          string            `long:"s3-acl" env:"AWS_S3_ACL" default:"private" description:"Canned ACL to apply to uploaded archives"`
+	AwsSSE          string            `long:"s3-sse" env:"AWS_S3_SSE" description:"Server-side encryption of uploaded archives, AES256 or aws:kms"`
+	AwsSSEKey       string            `long:"s3-sse-kms-key" env:"AWS_S3_SSE_KMS_KEY" description:"KMS key ID to encrypt with when --s3-sse is aws:kms (the account default if not set)"`
+	AwsStorageClass string            `long:"s3-storage-class" env:"AWS_S3_STORAGE_CLASS" description:"Storage class of uploaded archives, e.g. STANDARD_IA or GLACIER"`
+	AwsMetadata     map[string]string `long:"s3-meta" env:"AWS_S3_META" env-delim:"," description:"Extra x-amz-meta-* entries for uploaded archives, as name:value"`
+
+	Force bool `long:"force" description:"Upload even if the cluster hasn't changed since the last upload"`
+	Keep  int  `long:"keep" env:"AWS_S3_KEEP" description:"After every upload, delete all but this many of the most recent archives of the cluster (all are kept if 0)"`
+
+	NotifyOptions
+	RedactOptions
+
+	redactor *backup.Redactor
+	last     *backupStatus
 }
 
 var toS3 ToS3
 
+func (l *S3Location) check() error {
+	switch l.AwsSignature {
+	case "v2", "v4":
+	default:
+		return fmt.Errorf("unknown S3 signature version %q, expected v2 or v4", l.AwsSignature)
+	}
+
+	if _, err := parseKeyTemplate(l.KeyTemplate); err != nil {
+		return fmt.Errorf("invalid key template: %v", err)
+	}
+	return nil
+}
+
+// bucket returns the bucket, resolving the AWS credentials to reach it.
+func (l *S3Location) bucket() (objectStore, error) {
+	auth, err := l.awsCredentials().Auth()
+	if err != nil {
+		return nil, err
+	}
+	s3w := S3Writer{
+		Auth:        auth,
+		Endpoint:    l.AwsS3Endpoint,
+		Bucket:      l.AwsBucket,
+		Region:      l.AwsRegion,
+		Signature:   l.AwsSignature,
+		VirtualHost: l.AwsVirtualHost,
+	}
+	return s3w.bucket()
+}
+
+// awsCredentials returns the credential chain shared by every request of
+// this process, so that temporary credentials are only refreshed when they
+// near expiry.
+func (l *S3Location) awsCredentials() *credentialChain {
+	if l.credentials == nil {
+		l.credentials = &credentialChain{
+			AccessKey:    l.AwsAccessKey,
+			SecretKey:    l.AwsSecretKey,
+			SessionToken: l.AwsSessionToken,
+			Profile:      l.AwsProfile,
+		}
+	}
+	return l.credentials
+}
+
+func (o *ToS3) checkOptions() error {
+	if err := o.check(); err != nil {
+		return err
+	}
+
+	switch o.AwsSSE {
+	case "", "AES256", "aws:kms":
+	default:
+		return fmt.Errorf("unknown S3 server-side encryption %q, expected AES256 or aws:kms", o.AwsSSE)
+	}
+	if o.AwsSSEKey != "" && o.AwsSSE != "aws:kms" {
+		return fmt.Errorf("a KMS key requires --s3-sse=aws:kms")
+	}
+
+	var err error
+	if o.redactor, err = o.newRedactor(); err != nil {
+		return err
+	}
+
+	return o.checkNotifyOptions()
+}
+
+// objectKey names the archive of a snapshot taken at etcdIndex.
+func (o *ToS3) objectKey(etcdIndex uint64) (string, error) {
+	tmpl, err := parseKeyTemplate(o.KeyTemplate)
+	if err != nil {
+		return "", err
+	}
+	return renderKey(tmpl, newKeyFields(o.ClusterName, etcdIndex))
+}
+
+func (o *ToS3) s3Writer(auth aws.Auth) S3Writer {
+	return S3Writer{
+		Auth:         auth,
+		Endpoint:     o.AwsS3Endpoint,
+		Bucket:       o.AwsBucket,
+		Region:       o.AwsRegion,
+		Signature:    o.AwsSignature,
+		VirtualHost:  o.AwsVirtualHost,
+		ACL:          s3.ACL(o.AwsACL),
+		SSE:          o.AwsSSE,
+		SSEKey:       o.AwsSSEKey,
+		StorageClass: o.AwsStorageClass,
+		Meta:         o.AwsMetadata,
+	}
+}
+
 func (o *ToS3) Execute(args []string) error {
+	if err := o.checkOptions(); err != nil {
+		return err
+	}
+
 	client := etcd.NewClient(opts.EtcdMachines)
-	doSnapshot(client)
-	return nil
+	err := newBackupJob("", opts.EtcdMachines, o, nil, defaultStatusStore()).backup(client)
+	<-notificationsDone()
+	return err
 }
 
 type S3OnInterval struct {
 	MaxPeriod         func(string) `long:"max-period" env:"MAX_PERIOD" description:"Longest time to wait between snapshots if there are no updates" default:"168h"`
 	MinPeriod         func(string) `long:"min-period" env:"MIN_PERIOD" default:"1h" description:"How long to wait after an update to push the snapshot to S3"`
+	Schedule          string       `long:"schedule" env:"SCHEDULE" description:"Cron expression (minute hour day-of-month month day-of-week, in UTC) for scheduled snapshots, replacing --max-period"`
+	Blackouts         []string     `long:"blackout" env:"BLACKOUT" env-delim:"," description:"Daily UTC window in which no snapshot starts, as HH:MM-HH:MM; may be repeated"`
+	Jitter            func(string) `long:"jitter" env:"JITTER" default:"0s" description:"Delay scheduled snapshots by a random duration up to this long"`
+	StaleAfter        func(string) `long:"notify-stale-after" env:"NOTIFY_STALE_AFTER" description:"Send a stale notification when no backup succeeded for this long"`
+	LockKey           string       `long:"lock-key" env:"LOCK_KEY" description:"etcd key used to elect a single replica to take backups"`
+	LockID            string       `long:"lock-id" env:"LOCK_ID" description:"Identity of this replica in the lock key (hostname:pid if not set)"`
+	LockTTL           func(string) `long:"lock-ttl" env:"LOCK_TTL" default:"30s" description:"How long the lock outlives a replica that stopped refreshing it, at least 1s"`
+	ShutdownTimeout   func(string) `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" default:"60s" description:"How long to wait on SIGTERM or SIGINT for the running and last snapshots, and their notifications, before giving up"`
 	MaxPeriodDuration time.Duration
 	MinPeriodDuration time.Duration
+	JitterDuration    time.Duration
+	LockTTLDuration   time.Duration
+	StaleDuration     time.Duration
+	ShutdownDuration  time.Duration
 }
 
 var s3OnInterval S3OnInterval
 
 func (o *S3OnInterval) Execute(args []string) error {
-	client := etcd.NewClient(opts.EtcdMachines)
-	events := make(chan *etcd.Response)
-	go client.Watch("/", 0, true, events, nil)
-	log.Info("listening for changes")
-
-	var snapshotMutex sync.Mutex
-	snapshotCondition := sync.NewCond(&snapshotMutex)
-	go func() {
-		for {
-			snapshotCondition.L.Lock()
-			snapshotCondition.Wait()
+	j := newBackupJob("", opts.EtcdMachines, &toS3, o, defaultStatusStore())
+	if err := j.check(); err != nil {
+		return err
+	}
+	j.options = func() (*clusterOptions, error) {
+		return continuousOptions(os.Args[1:])
+	}
 
-			log.Debug("snapshot triggered, waiting for minperiod")
-			time.Sleep(o.MinPeriodDuration)
+	serveMetrics(opts.MetricsAddr)
+	return runJobs([]*backupJob{j}, o.ShutdownDuration)
+}
 
-			log.Debug("minperiod expired, taking a snapshot")
-			doSnapshot(client)
-			snapshotCondition.L.Unlock()
+// ignoreKeys forwards the events not concerning any of keys.
+func ignoreKeys(events <-chan *etcd.Response, keys []string) <-chan *etcd.Response {
+	filtered := make(chan *etcd.Response)
+	go func() {
+		defer close(filtered)
+	events:
+		for event := range events {
+			for _, key := range keys {
+				if event.Node != nil && event.Node.Key == key {
+					continue events
+				}
+			}
+			filtered <- event
 		}
 	}()
+	return filtered
+}
 
-	maxPeriodTicker := time.NewTicker(o.MaxPeriodDuration)
+// check validates the options that aren't the schedule's. etcd TTLs are
+// whole seconds, and the lock is refreshed every third of its TTL, so
+// shorter TTLs would never expire or hammer etcd.
+func (o *S3OnInterval) check() error {
+	if o.LockTTLDuration < time.Second {
+		return fmt.Errorf("lock TTL of %s is too short, it must be at least 1s", o.LockTTLDuration)
+	}
+	return nil
+}
+
+func (o *S3OnInterval) scheduler() (*scheduler, error) {
+	var schedule *cronSchedule
+	if o.Schedule != "" {
+		var err error
+		if schedule, err = parseCron(o.Schedule); err != nil {
+			return nil, err
+		}
+	}
 
-	for {
-		select {
-		case <-maxPeriodTicker.C:
-			log.Debug("maxperiod expired, taking snapshot")
-			doSnapshot(client)
-		case <-events:
-			snapshotCondition.Signal()
+	var blackouts []window
+	for _, b := range o.Blackouts {
+		w, err := parseWindow(b)
+		if err != nil {
+			return nil, err
 		}
+		blackouts = append(blackouts, w)
 	}
+
+	return newScheduler(schedule, o.MaxPeriodDuration, o.MinPeriodDuration, blackouts, o.JitterDuration), nil
 }
 
-func init() {
-	s3OnInterval.MaxPeriod = func(dur string) {
+// bindDurations parses the duration options of o into their fields.
+func (o *S3OnInterval) bindDurations() {
+	o.MaxPeriod = func(dur string) {
 		if pDur, err := time.ParseDuration(dur); err != nil {
 			log.WithFields(log.Fields{
 				"error":    err,
 				"duration": dur,
 			}).Fatal("could not parse maxperiod")
 		} else {
-			s3OnInterval.MaxPeriodDuration = pDur
+			o.MaxPeriodDuration = pDur
 		}
 	}
 
-	s3OnInterval.MinPeriod = func(dur string) {
+	o.MinPeriod = func(dur string) {
 		if pDur, err := time.ParseDuration(dur); err != nil {
 			log.WithFields(log.Fields{
 				"error":    err,
 				"duration": dur,
 			}).Fatal("could not parse minperiod")
 		} else {
-			s3OnInterval.MinPeriodDuration = pDur
+			o.MinPeriodDuration = pDur
+		}
+	}
+
+	o.Jitter = func(dur string) {
+		if pDur, err := time.ParseDuration(dur); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"duration": dur,
+			}).Fatal("could not parse jitter")
+		} else {
+			o.JitterDuration = pDur
+		}
+	}
+
+	o.LockTTL = func(dur string) {
+		if pDur, err := time.ParseDuration(dur); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"duration": dur,
+			}).Fatal("could not parse lock ttl")
+		} else {
+			o.LockTTLDuration = pDur
+		}
+	}
+
+	o.StaleAfter = func(dur string) {
+		if pDur, err := time.ParseDuration(dur); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"duration": dur,
+			}).Fatal("could not parse stale notification period")
+		} else {
+			o.StaleDuration = pDur
+		}
+	}
+
+	o.ShutdownTimeout = func(dur string) {
+		if pDur, err := time.ParseDuration(dur); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"duration": dur,
+			}).Fatal("could not parse shutdown timeout")
+		} else {
+			o.ShutdownDuration = pDur
 		}
 	}
+}
+
+func init() {
+	s3OnInterval.bindDurations()
 
 	s3Cmd, _ := parser.AddCommand("s3",
 		"Output to S3 bucket",
@@ -104,42 +321,130 @@ func init() {
 		"Backup an etcd database at regular intervals, or after changes",
 		&s3OnInterval,
 	)
+	s3Cmd.AddCommand("list",
+		"List backups in S3 bucket",
+		"List the archives of this cluster in an S3 bucket, along with the etcd index and key count recorded when they were uploaded",
+		&s3List,
+	)
 }
 
-func doSnapshot(client *etcd.Client) {
-	log.Info("taking a snapshot")
+type S3Writer struct {
+	Auth             aws.Auth
+	Endpoint, Bucket string
+
+	// Region names the AWS region of the bucket. Signature is either "v2"
+	// or "v4". VirtualHost puts the bucket name into the hostname rather
+	// than the request path.
+	Region, Signature string
+	VirtualHost       bool
 
-	response, err := client.Get("/", false, true)
+	// ACL, SSE ("AES256" or "aws:kms"), SSEKey and StorageClass map onto
+	// the corresponding upload headers. Meta entries are sent as
+	// x-amz-meta-* headers with every upload.
+	ACL                       s3.ACL
+	SSE, SSEKey, StorageClass string
+	Meta                      map[string]string
+}
+
+// Metadata recorded on every uploaded archive.
+const (
+	metaCluster   = "etcd-cluster"
+	metaEtcdIndex = "etcd-index"
+	metaKeyCount  = "etcd-keys"
+	// metaContentHash is the hash of the archived keys and values, which
+	// tells whether the cluster changed since.
+	metaContentHash = "etcd-content-hash"
+)
+
+// WriteToS3 uploads an archive to path, adding meta to the configured object
+// metadata.
+func (s3w S3Writer) WriteToS3(path string, p []byte, meta map[string]string) error {
+	bucket, err := s3w.bucket()
 	if err != nil {
-		log.WithField("error", err).Fatal("could not retrieve etcd root node")
+		return err
 	}
-	buffer := FillTarballBuffer(response.Node)
 
-	s3Writer := S3Writer{
-		AccessKey:   toS3.AwsAccessKey,
-		SecretKey:   toS3.AwsSecretKey,
-		Endpoint:    toS3.AwsS3Endpoint,
-		Bucket:      toS3.AwsBucket,
-		ClusterName: toS3.ClusterName,
+	acl := s3w.ACL
+	if acl == "" {
+		acl = s3.Private
 	}
-	s3Writer.WriteToS3(buffer.Bytes())
-	log.Info("wrote to bucket")
+	return bucket.PutHeader(path, p, s3w.headers(meta), acl)
 }
 
-type S3Writer struct {
-	AccessKey, SecretKey, Endpoint, Bucket string
+func (s3w S3Writer) headers(meta map[string]string) map[string][]string {
+	headers := map[string][]string{
+		"Content-Type": {"application/x-gzip"},
+	}
+
+	if s3w.SSE != "" {
+		headers["x-amz-server-side-encryption"] = []string{s3w.SSE}
+	}
+	if s3w.SSEKey != "" {
+		headers["x-amz-server-side-encryption-aws-kms-key-id"] = []string{s3w.SSEKey}
+	}
+	if s3w.StorageClass != "" {
+		headers["x-amz-storage-class"] = []string{s3w.StorageClass}
+	}
+
+	for name, value := range s3w.Meta {
+		headers["x-amz-meta-"+strings.ToLower(name)] = []string{value}
+	}
+	for name, value := range meta {
+		headers["x-amz-meta-"+name] = []string{value}
+	}
 
-	ClusterName string
+	return headers
 }
 
-func (s3w S3Writer) WriteToS3(p []byte) error {
-	auth := aws.Auth{
-		AccessKey: s3w.AccessKey,
-		SecretKey: s3w.SecretKey,
+func (s3w S3Writer) bucket() (objectStore, error) {
+	auth := s3w.Auth
+	region := s3w.region()
+
+	switch s3w.Signature {
+	case "v4":
+		return &v4Bucket{Auth: auth, Region: region, Name: s3w.Bucket}, nil
+	case "v2", "":
+		return s3.New(auth, region).Bucket(s3w.Bucket), nil
+	default:
+		return nil, fmt.Errorf("unknown S3 signature version %q", s3w.Signature)
 	}
-	path := fmt.Sprintf("%s-%s.tar.gz", s3w.ClusterName, time.Now().UTC().Format(time.RFC3339))
+}
 
-	client := s3.New(auth, aws.Region{S3Endpoint: s3w.Endpoint})
-	bucket := client.Bucket(s3w.Bucket)
-	return bucket.Put(path, p, "application/x-gzip", s3.Private, s3.Options{})
+// region resolves the endpoints for the configured region. Regions unknown
+// to goamz get the standard AWS endpoint. Buckets are addressed path-style
+// unless VirtualHost is set. An explicit endpoint always wins, and is always
+// addressed path-style: it is usually an S3-compatible store, which can't be
+// expected to resolve bucket hostnames. So are bucket names with dots, which
+// the wildcard certificates of AWS don't cover.
+func (s3w S3Writer) region() aws.Region {
+	region, ok := aws.Regions[s3w.Region]
+	if !ok {
+		region = aws.Region{
+			Name:       s3w.Region,
+			S3Endpoint: fmt.Sprintf("https://s3.%s.amazonaws.com", s3w.Region),
+		}
+	}
+	if s3w.Endpoint != "" {
+		region.S3Endpoint = s3w.Endpoint
+		region.S3BucketEndpoint = ""
+		return region
+	}
+
+	switch {
+	case !s3w.VirtualHost || strings.Contains(s3w.Bucket, "."):
+		region.S3BucketEndpoint = ""
+	case region.S3BucketEndpoint == "":
+		region.S3BucketEndpoint = bucketEndpoint(region.S3Endpoint)
+	}
+	return region
+}
+
+// bucketEndpoint turns an endpoint URL into a goamz virtual-hosted bucket
+// endpoint, e.g. https://s3.amazonaws.com -> https://${bucket}.s3.amazonaws.com
+func bucketEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://${bucket}." + u.Host + u.Path
 }
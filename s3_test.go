@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/goamz/goamz/s3/s3test"
+)
+
+const testBucket = "etcdbackups"
+
+var testAuth = aws.Auth{AccessKey: "access", SecretKey: "secret"}
+
+// newS3Server starts an S3 server holding an empty testBucket.
+func newS3Server(t *testing.T) *s3test.Server {
+	t.Helper()
+	srv, err := s3test.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Quit)
+
+	region := aws.Region{Name: "eu-west-1", S3Endpoint: srv.URL(), S3LocationConstraint: true}
+	if err := s3.New(testAuth, region).Bucket(testBucket).PutBucket(s3.Private); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestS3WriterRegion(t *testing.T) {
+	tests := []struct {
+		name           string
+		s3w            S3Writer
+		endpoint       string
+		bucketEndpoint string
+	}{
+		{
+			name:     "derived endpoint",
+			s3w:      S3Writer{Region: "us-east-1", Bucket: "etcdbackups"},
+			endpoint: "https://s3.amazonaws.com",
+		},
+		{
+			name:           "derived endpoint, virtual host",
+			s3w:            S3Writer{Region: "us-east-1", Bucket: "etcdbackups", VirtualHost: true},
+			endpoint:       "https://s3.amazonaws.com",
+			bucketEndpoint: "https://${bucket}.s3.amazonaws.com",
+		},
+		{
+			name:     "virtual host, bucket name with dots",
+			s3w:      S3Writer{Region: "us-east-1", Bucket: "etcd.backups.example.com", VirtualHost: true},
+			endpoint: "https://s3.amazonaws.com",
+		},
+		{
+			name:           "region unknown to goamz",
+			s3w:            S3Writer{Region: "eu-south-2", Bucket: "etcdbackups", Signature: "v4", VirtualHost: true},
+			endpoint:       "https://s3.eu-south-2.amazonaws.com",
+			bucketEndpoint: "https://${bucket}.s3.eu-south-2.amazonaws.com",
+		},
+		{
+			name:     "explicit endpoint",
+			s3w:      S3Writer{Region: "us-east-1", Endpoint: "http://127.0.0.1:9000"},
+			endpoint: "http://127.0.0.1:9000",
+		},
+		{
+			// The endpoint is addressed path-style regardless.
+			name:     "explicit endpoint, virtual host",
+			s3w:      S3Writer{Region: "us-east-1", Endpoint: "http://minio:9000", VirtualHost: true},
+			endpoint: "http://minio:9000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region := tt.s3w.region()
+			if region.S3Endpoint != tt.endpoint {
+				t.Errorf("S3Endpoint = %q, want %q", region.S3Endpoint, tt.endpoint)
+			}
+			if region.S3BucketEndpoint != tt.bucketEndpoint {
+				t.Errorf("S3BucketEndpoint = %q, want %q", region.S3BucketEndpoint, tt.bucketEndpoint)
+			}
+		})
+	}
+}
+
+// virtualHostFront serves srv to clients addressing buckets in the
+// hostname, which s3test doesn't understand, by moving the bucket into the
+// path.
+func virtualHostFront(t *testing.T, srv *s3test.Server) *httptest.Server {
+	t.Helper()
+	target, err := url.Parse(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket := strings.SplitN(r.Host, ".", 2)[0]
+		r.URL.Path = "/" + bucket + r.URL.Path
+		r.URL.RawPath = ""
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(front.Close)
+	return front
+}
+
+func TestS3WriterRoundTrip(t *testing.T) {
+	// Virtual-host requests go to bucket.s3.etcdbk.test, which the v4
+	// client is made to dial to the front. goamz dials on its own, so its
+	// virtual-host addressing is only covered by TestS3WriterRegion.
+	aws.Regions["etcdbk-test"] = aws.Region{Name: "etcdbk-test", S3Endpoint: "http://s3.etcdbk.test"}
+	defer delete(aws.Regions, "etcdbk-test")
+
+	tests := []struct {
+		signature   string
+		virtualHost bool
+	}{
+		{signature: "v2"},
+		{signature: "v4"},
+		{signature: "v4", virtualHost: true},
+	}
+
+	for _, tt := range tests {
+		name := tt.signature + "/path-style"
+		if tt.virtualHost {
+			name = tt.signature + "/virtual-host"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := newS3Server(t)
+			s3w := S3Writer{
+				Auth:      testAuth,
+				Endpoint:  srv.URL(),
+				Bucket:    testBucket,
+				Region:    "eu-west-1",
+				Signature: tt.signature,
+				Meta:      map[string]string{"Team": "infra"},
+			}
+			if tt.virtualHost {
+				s3w.Endpoint = ""
+				s3w.Region = "etcdbk-test"
+				s3w.VirtualHost = true
+			}
+
+			bucket, err := s3w.bucket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.virtualHost {
+				front := virtualHostFront(t, srv)
+				bucket.(*v4Bucket).client.Transport = &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, network, front.Listener.Addr().String())
+					},
+				}
+			}
+
+			const key = "etcd/my-cluster-42.tar.gz"
+			// What WriteToS3 does, on the bucket the client of which was
+			// replaced.
+			if err := bucket.PutHeader(key, []byte("archive"), s3w.headers(map[string]string{metaEtcdIndex: "42"}), s3.Private); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := bucket.Head(key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("x-amz-meta-" + metaEtcdIndex); got != "42" {
+				t.Errorf("etcd index metadata = %q, want 42", got)
+			}
+			if got := resp.Header.Get("x-amz-meta-team"); got != "infra" {
+				t.Errorf("--s3-meta metadata = %q, want infra", got)
+			}
+
+			list, err := bucket.List("etcd/", "", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Contents) != 1 || list.Contents[0].Key != key {
+				t.Fatalf("List = %+v, want only %s", list.Contents, key)
+			}
+
+			if err := bucket.Del(key); err != nil {
+				t.Fatal(err)
+			}
+			if list, err = bucket.List("etcd/", "", "", 0); err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Contents) != 0 {
+				t.Errorf("List after Del = %+v, want nothing", list.Contents)
+			}
+		})
+	}
+}
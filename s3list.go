@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+type S3List struct{}
+
+var s3List S3List
+
+func (o *S3List) Execute(args []string) error {
+	if err := toS3.checkOptions(); err != nil {
+		return err
+	}
+
+	bucket, err := toS3.bucket()
+	if err != nil {
+		return err
+	}
+
+	keys, err := toS3.archives(bucket)
+	if err != nil {
+		log.WithField("error", err).Warn("could not list bucket")
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tLAST MODIFIED\tETCD INDEX\tKEYS")
+
+	for _, key := range keys {
+		var meta http.Header
+		if resp, err := bucket.Head(key.Key, nil); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   key.Key,
+			}).Warn("could not read archive metadata")
+		} else {
+			resp.Body.Close()
+			meta = resp.Header
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+			key.Key,
+			key.Size,
+			key.LastModified,
+			metaValue(meta, metaEtcdIndex),
+			metaValue(meta, metaKeyCount),
+		)
+	}
+
+	return w.Flush()
+}
+
+// metaValue returns the x-amz-meta-* entry called name, or "-" for archives
+// uploaded without it.
+func metaValue(header http.Header, name string) string {
+	if value := header.Get("x-amz-meta-" + name); value != "" {
+		return value
+	}
+	return "-"
+}
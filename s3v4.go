@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// objectStore is the subset of *s3.Bucket that etcdbk relies on. The vendored
+// goamz client only signs requests with Signature Version 2, so v4Bucket
+// provides the same methods for stores that require Version 4.
+type objectStore interface {
+	PutHeader(path string, data []byte, customHeaders map[string][]string, perm s3.ACL) error
+	Head(path string, headers map[string][]string) (*http.Response, error)
+	GetReader(path string) (io.ReadCloser, error)
+	List(prefix, delim, marker string, max int) (*s3.ListResp, error)
+	Del(path string) error
+}
+
+// v4Bucket is a minimal S3 bucket client which signs its requests with AWS
+// Signature Version 4.
+type v4Bucket struct {
+	Auth   aws.Auth
+	Region aws.Region
+	Name   string
+
+	client http.Client
+}
+
+func (b *v4Bucket) PutHeader(path string, data []byte, customHeaders map[string][]string, perm s3.ACL) error {
+	headers := http.Header{
+		"Content-Type": {"application/text"},
+		"x-amz-acl":    {string(perm)},
+	}
+	for k, v := range customHeaders {
+		headers[k] = v
+	}
+
+	resp, err := b.do("PUT", path, nil, headers, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *v4Bucket) Head(path string, headers map[string][]string) (*http.Response, error) {
+	resp, err := b.do("HEAD", path, nil, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (b *v4Bucket) GetReader(path string) (io.ReadCloser, error) {
+	resp, err := b.do("GET", path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *v4Bucket) Del(path string) error {
+	resp, err := b.do("DELETE", path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *v4Bucket) List(prefix, delim, marker string, max int) (*s3.ListResp, error) {
+	params := url.Values{
+		"prefix":    {prefix},
+		"delimiter": {delim},
+		"marker":    {marker},
+	}
+	if max != 0 {
+		params.Set("max-keys", strconv.Itoa(max))
+	}
+
+	resp, err := b.do("GET", "", params, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &s3.ListResp{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// url returns the address of the object at path, honouring the addressing
+// style of the region. Path segments are escaped the way S3 expects them in
+// the canonical request.
+func (b *v4Bucket) url(path string, params url.Values) (*url.URL, error) {
+	endpoint := b.Region.S3Endpoint
+	objectPath := "/" + b.Name + "/" + path
+	if b.Region.S3BucketEndpoint != "" {
+		endpoint = strings.Replace(b.Region.S3BucketEndpoint, "${bucket}", b.Name, -1)
+		objectPath = "/" + path
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad S3 endpoint URL %q: %v", endpoint, err)
+	}
+
+	segments := strings.Split(objectPath, "/")
+	for i, segment := range segments {
+		segments[i] = aws.Encode(segment)
+	}
+	prefix := strings.TrimSuffix(u.Path, "/")
+	u.Path = prefix + objectPath
+	u.RawPath = prefix + strings.Join(segments, "/")
+	u.RawQuery = params.Encode()
+	return u, nil
+}
+
+func (b *v4Bucket) do(method, path string, params url.Values, headers http.Header, data []byte) (*http.Response, error) {
+	u, err := b.url(path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(data)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(sum[:]))
+	if token := b.Auth.Token(); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	aws.NewV4Signer(b.Auth, "s3", b.Region).Sign(req)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		s3Err := &s3.Error{}
+		xml.NewDecoder(resp.Body).Decode(s3Err)
+		s3Err.StatusCode = resp.StatusCode
+		if s3Err.Message == "" {
+			s3Err.Message = resp.Status
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// clock is the source of time for the scheduler, so that schedules can be
+// driven by a fake clock.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// window is a daily span of UTC time, from start up to but excluding end,
+// both measured from midnight. A window whose end comes before its start
+// spans midnight.
+type window struct {
+	start, end time.Duration
+}
+
+// parseWindow reads windows such as "09:00-10:00" or "23:30-00:15".
+func parseWindow(s string) (window, error) {
+	var startHour, startMinute, endHour, endMinute int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute); err != nil {
+		return window{}, fmt.Errorf("window %q is not in HH:MM-HH:MM form", s)
+	}
+
+	w := window{
+		start: time.Duration(startHour)*time.Hour + time.Duration(startMinute)*time.Minute,
+		end:   time.Duration(endHour)*time.Hour + time.Duration(endMinute)*time.Minute,
+	}
+	if startHour > 23 || endHour > 23 || startMinute > 59 || endMinute > 59 || w.start == w.end {
+		return window{}, fmt.Errorf("window %q is not a valid span of the day", s)
+	}
+	return w, nil
+}
+
+// remaining returns how long t stays inside the window, zero if it is
+// outside of it.
+func (w window) remaining(t time.Time) time.Duration {
+	t = t.UTC()
+	sinceMidnight := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+
+	switch {
+	case w.start < w.end && sinceMidnight >= w.start && sinceMidnight < w.end:
+		return w.end - sinceMidnight
+	case w.start > w.end && sinceMidnight >= w.start:
+		return 24*time.Hour - sinceMidnight + w.end
+	case w.start > w.end && sinceMidnight < w.end:
+		return w.end - sinceMidnight
+	}
+	return 0
+}
+
+// scheduler decides when the continuous backup takes snapshots: on a cron
+// schedule (or every maxPeriod without one), and minPeriod after a change.
+// No snapshot starts during a blackout window; it is taken when the window
+// closes instead. Scheduled snapshots are delayed by a random jitter so that
+// a fleet of daemons does not hit etcd at the same moment.
+type scheduler struct {
+	clock  clock
+	random func(n int64) int64
+	log    *log.Entry
+
+	// The settings can be replaced by update while running.
+	mu        sync.Mutex
+	schedule  *cronSchedule
+	maxPeriod time.Duration
+	minPeriod time.Duration
+	blackouts []window
+	jitter    time.Duration
+	updated   chan struct{}
+}
+
+// update replaces the settings of s with those of other, rescheduling the
+// next scheduled snapshot if s is running.
+func (s *scheduler) update(other *scheduler) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedule = other.schedule
+	s.maxPeriod = other.maxPeriod
+	s.minPeriod = other.minPeriod
+	s.blackouts = other.blackouts
+	s.jitter = other.jitter
+
+	select {
+	case s.updated <- struct{}{}:
+	default:
+		// Run hasn't caught up with the previous update yet.
+	}
+}
+
+// nextScheduled returns the time of the scheduled snapshot following t,
+// before jitter.
+func (s *scheduler) nextScheduled(t time.Time) time.Time {
+	if s.schedule != nil {
+		return s.schedule.Next(t)
+	}
+	return t.Add(s.maxPeriod)
+}
+
+// untilScheduled returns the scheduled snapshot following last, and how long
+// to wait for it including jitter. Occurrences missed while a snapshot was
+// running are skipped.
+func (s *scheduler) untilScheduled(last time.Time) (time.Time, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	next := s.nextScheduled(last)
+	if next.Before(now) {
+		next = s.nextScheduled(now)
+	}
+	if next.IsZero() {
+		return next, time.Duration(1<<63 - 1)
+	}
+
+	wait := next.Sub(now)
+	if s.jitter > 0 {
+		wait += time.Duration(s.random(int64(s.jitter)))
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return next, wait
+}
+
+// blackout returns how long until the current blackout window ends, zero if
+// snapshots are currently allowed.
+func (s *scheduler) blackout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	var longest time.Duration
+	for _, w := range s.blackouts {
+		if r := w.remaining(now); r > longest {
+			longest = r
+		}
+	}
+	return longest
+}
+
+// Run triggers snapshot according to the schedule and the changes reported
+// on changes, and right away for every value on requests. Once stop is
+// closed, it takes a last snapshot if changes are still waiting for one,
+// then returns. Neither requested nor last snapshots wait for blackout
+// windows to end.
+func (s *scheduler) Run(changes <-chan *etcd.Response, requests <-chan struct{}, stop <-chan struct{}, snapshot func()) {
+	// last is when the previous scheduled snapshot was due.
+	last := s.clock.Now()
+	next, wait := s.untilScheduled(last)
+	scheduled := s.clock.After(wait)
+	s.log.WithField("next", next).Debug("scheduled next snapshot")
+
+	// pending fires when a snapshot triggered by a change, or held back by
+	// a blackout window, is due.
+	var pending <-chan time.Time
+
+	take := func(reason string) {
+		if remaining := s.blackout(); remaining > 0 {
+			s.log.WithFields(log.Fields{
+				"reason": reason,
+				"delay":  remaining,
+			}).Info("snapshot falls in a blackout window, postponing")
+			pending = s.clock.After(remaining)
+			return
+		}
+
+		s.log.WithField("reason", reason).Debug("taking snapshot")
+		snapshot()
+	}
+
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				s.log.Warn("stopped watching for changes, only scheduled snapshots will be taken")
+				changes = nil
+				continue
+			}
+			if pending == nil {
+				s.log.Debug("snapshot triggered, waiting for minperiod")
+				s.mu.Lock()
+				pending = s.clock.After(s.minPeriod)
+				s.mu.Unlock()
+			}
+		case <-pending:
+			pending = nil
+			take("change")
+		case <-requests:
+			s.log.WithField("reason", "request").Debug("taking snapshot")
+			snapshot()
+		case <-stop:
+			if pending != nil {
+				s.log.Info("taking a last snapshot of pending changes")
+				snapshot()
+			}
+			return
+		case <-scheduled:
+			take("schedule")
+			last = next
+			next, wait = s.untilScheduled(last)
+			scheduled = s.clock.After(wait)
+			s.log.WithField("next", next).Debug("scheduled next snapshot")
+		case <-s.updated:
+			next, wait = s.untilScheduled(last)
+			scheduled = s.clock.After(wait)
+			s.log.WithField("next", next).Info("rescheduled next snapshot")
+		}
+	}
+}
+
+func newScheduler(schedule *cronSchedule, maxPeriod, minPeriod time.Duration, blackouts []window, jitter time.Duration) *scheduler {
+	return &scheduler{
+		clock:     realClock{},
+		schedule:  schedule,
+		maxPeriod: maxPeriod,
+		minPeriod: minPeriod,
+		blackouts: blackouts,
+		jitter:    jitter,
+		updated:   make(chan struct{}, 1),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())).Int63n,
+		log:       log.NewEntry(log.StandardLogger()),
+	}
+}
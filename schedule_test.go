@@ -0,0 +1,329 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now string) *fakeClock {
+	t, err := time.Parse(time.RFC3339, now)
+	if err != nil {
+		panic(err)
+	}
+	return &fakeClock{now: t}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the timers due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var waiting []fakeTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			waiting = append(waiting, timer)
+			continue
+		}
+		timer.c <- timer.at
+	}
+	c.timers = waiting
+}
+
+// blockUntil waits for n timers to be waiting, i.e. for whoever uses the
+// clock to be done reacting to the last Advance.
+func (c *fakeClock) blockUntil(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		waiting := len(c.timers)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d timers", n)
+}
+
+func TestParseWindow(t *testing.T) {
+	w, err := parseWindow("23:30-00:15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.start != 23*time.Hour+30*time.Minute || w.end != 15*time.Minute {
+		t.Errorf("parseWindow = %+v", w)
+	}
+
+	for _, s := range []string{"", "nine to five", "09:00", "24:00-01:00", "09:60-10:00", "10:00-10:00"} {
+		if _, err := parseWindow(s); err == nil {
+			t.Errorf("parseWindow(%q) accepted it", s)
+		}
+	}
+}
+
+func TestWindowRemaining(t *testing.T) {
+	tests := []struct {
+		window string
+		at     string
+		want   time.Duration
+	}{
+		{"09:00-10:00", "2016-02-11T08:59:59Z", 0},
+		{"09:00-10:00", "2016-02-11T09:00:00Z", time.Hour},
+		{"09:00-10:00", "2016-02-11T09:45:00Z", 15 * time.Minute},
+		{"09:00-10:00", "2016-02-11T10:00:00Z", 0},
+		// Spanning midnight.
+		{"23:30-00:15", "2016-02-11T23:29:00Z", 0},
+		{"23:30-00:15", "2016-02-11T23:30:00Z", 45 * time.Minute},
+		{"23:30-00:15", "2016-02-11T23:45:00Z", 30 * time.Minute},
+		{"23:30-00:15", "2016-02-12T00:00:00Z", 15 * time.Minute},
+		{"23:30-00:15", "2016-02-12T00:10:00Z", 5 * time.Minute},
+		{"23:30-00:15", "2016-02-12T00:15:00Z", 0},
+		{"23:30-00:15", "2016-02-12T12:00:00Z", 0},
+		// In UTC.
+		{"09:00-10:00", "2016-02-11T11:30:00+02:00", 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.window+" at "+tt.at, func(t *testing.T) {
+			w, err := parseWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.remaining(at); got != tt.want {
+				t.Errorf("remaining = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	schedule, err := parseCron("@hourly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newScheduler(schedule, 0, 0, nil, 5*time.Minute)
+	s.clock = newFakeClock("2016-02-11T09:50:00Z")
+
+	for _, drawn := range []int64{0, int64(time.Minute), int64(5*time.Minute) - 1} {
+		s.random = func(n int64) int64 {
+			if n != int64(5*time.Minute) {
+				t.Errorf("jitter drawn below %d, want below %d", n, 5*time.Minute)
+			}
+			return drawn
+		}
+		next, wait := s.untilScheduled(s.clock.Now())
+		if want := "2016-02-11T10:00:00Z"; next.Format(time.RFC3339) != want {
+			t.Errorf("next = %s, want %s", next.Format(time.RFC3339), want)
+		}
+		if want := 10*time.Minute + time.Duration(drawn); wait != want {
+			t.Errorf("wait = %s, want %s", wait, want)
+		}
+	}
+
+	// The real source stays within bounds.
+	s = newScheduler(schedule, 0, 0, nil, 5*time.Minute)
+	s.clock = newFakeClock("2016-02-11T09:50:00Z")
+	for i := 0; i < 1000; i++ {
+		if _, wait := s.untilScheduled(s.clock.Now()); wait < 10*time.Minute || wait >= 15*time.Minute {
+			t.Fatalf("wait = %s, want within [10m, 15m)", wait)
+		}
+	}
+}
+
+// runScheduler runs s until the returned stop function is called, sending
+// the time of every snapshot on the returned channel.
+func runScheduler(s *scheduler, changes <-chan *etcd.Response, requests <-chan struct{}) (<-chan time.Time, func()) {
+	taken := make(chan time.Time, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(changes, requests, stop, func() {
+			taken <- s.clock.Now()
+		})
+	}()
+	return taken, func() {
+		close(stop)
+		<-done
+		close(taken)
+	}
+}
+
+func expectSnapshot(t *testing.T, taken <-chan time.Time, want string) {
+	t.Helper()
+	select {
+	case at := <-taken:
+		if at.Format(time.RFC3339) != want {
+			t.Errorf("snapshot taken at %s, want %s", at.Format(time.RFC3339), want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no snapshot, want one at %s", want)
+	}
+}
+
+func TestSchedulerBlackout(t *testing.T) {
+	schedule, err := parseCron("@hourly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blackout, err := parseWindow("01:00-01:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock("2016-02-11T00:50:00Z")
+	s := newScheduler(schedule, 0, 0, []window{blackout}, 0)
+	s.clock = clock
+	taken, stop := runScheduler(s, nil, nil)
+
+	clock.blockUntil(t, 1)
+	clock.Advance(10 * time.Minute)
+	// The 01:00 snapshot waits for the blackout to end, the 02:00 one is
+	// scheduled meanwhile.
+	clock.blockUntil(t, 2)
+	clock.Advance(30 * time.Minute)
+	expectSnapshot(t, taken, "2016-02-11T01:30:00Z")
+	clock.Advance(30 * time.Minute)
+	expectSnapshot(t, taken, "2016-02-11T02:00:00Z")
+
+	stop()
+	if at, ok := <-taken; ok {
+		t.Errorf("unexpected snapshot at %s", at)
+	}
+}
+
+func TestSchedulerChanges(t *testing.T) {
+	blackout, err := parseWindow("12:00-13:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No scheduled snapshot gets in the way.
+	clock := newFakeClock("2016-02-11T11:00:00Z")
+	s := newScheduler(nil, 1000*time.Hour, 5*time.Minute, []window{blackout}, 0)
+	s.clock = clock
+	changes := make(chan *etcd.Response)
+	requests := make(chan struct{})
+	taken, stop := runScheduler(s, changes, requests)
+
+	// Changes are batched for minPeriod.
+	clock.blockUntil(t, 1)
+	changes <- &etcd.Response{}
+	changes <- &etcd.Response{}
+	clock.blockUntil(t, 2)
+	clock.Advance(5 * time.Minute)
+	expectSnapshot(t, taken, "2016-02-11T11:05:00Z")
+
+	// A change snapshot due in a blackout is taken when it ends.
+	clock.Advance(55 * time.Minute)
+	changes <- &etcd.Response{}
+	clock.blockUntil(t, 2)
+	clock.Advance(5 * time.Minute)
+	clock.blockUntil(t, 2)
+	clock.Advance(55 * time.Minute)
+	expectSnapshot(t, taken, "2016-02-11T13:00:00Z")
+
+	// Requests don't wait, blackout or not.
+	clock.Advance(23 * time.Hour)
+	requests <- struct{}{}
+	expectSnapshot(t, taken, "2016-02-12T12:00:00Z")
+
+	stop()
+	if at, ok := <-taken; ok {
+		t.Errorf("unexpected snapshot at %s", at)
+	}
+}
+
+func TestSchedulerLastSnapshot(t *testing.T) {
+	for _, pending := range []bool{false, true} {
+		clock := newFakeClock("2016-02-11T11:00:00Z")
+		s := newScheduler(nil, 24*time.Hour, 5*time.Minute, nil, 0)
+		s.clock = clock
+		changes := make(chan *etcd.Response)
+		taken, stop := runScheduler(s, changes, nil)
+
+		clock.blockUntil(t, 1)
+		if pending {
+			changes <- &etcd.Response{}
+			clock.blockUntil(t, 2)
+		}
+		stop()
+
+		var snapshots int
+		for range taken {
+			snapshots++
+		}
+		if pending && snapshots != 1 {
+			t.Errorf("%d snapshots on stop with changes pending, want 1", snapshots)
+		}
+		if !pending && snapshots != 0 {
+			t.Errorf("%d snapshots on stop with no changes pending, want none", snapshots)
+		}
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	hourly, err := parseCron("@hourly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	every5, err := parseCron("*/5 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock("2016-02-11T00:50:00Z")
+	s := newScheduler(hourly, 0, 0, nil, 0)
+	s.clock = clock
+	taken, stop := runScheduler(s, nil, nil)
+
+	clock.blockUntil(t, 1)
+	s.update(newScheduler(every5, 0, 0, nil, 0))
+	clock.blockUntil(t, 2)
+	clock.Advance(5 * time.Minute)
+	expectSnapshot(t, taken, "2016-02-11T00:55:00Z")
+	// The timer of the replaced schedule goes off unheard.
+	clock.blockUntil(t, 2)
+	clock.Advance(5 * time.Minute)
+	expectSnapshot(t, taken, "2016-02-11T01:00:00Z")
+
+	stop()
+	if at, ok := <-taken; ok {
+		t.Errorf("unexpected snapshot at %s", at)
+	}
+}
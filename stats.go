@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type Stats struct {
+	Archive string `long:"archive" short:"a" env:"STATS_ARCHIVE" description:"Archive to inspect instead of the cluster, - for STDIN"`
+	Format  string `long:"format" env:"STATS_FORMAT" default:"table" description:"Output format: table, json"`
+	Top     int    `long:"top" env:"STATS_TOP" default:"10" description:"How many of the largest values and deepest keys to list"`
+}
+
+var stats Stats
+
+// keyspaceStats describes the size and shape of a keyspace.
+type keyspaceStats struct {
+	Keys       int             `json:"keys"`
+	Dirs       int             `json:"dirs"`
+	ValueBytes int64           `json:"valueBytes"`
+	TTLKeys    int             `json:"ttlKeys"`
+	EtcdIndex  uint64          `json:"etcdIndex"`
+	Redacted   bool            `json:"redacted"`
+	Prefixes   []prefixStats   `json:"prefixes"`
+	Largest    []keySize       `json:"largest"`
+	Deepest    []keyDepth      `json:"deepest"`
+	IndexAge   []indexAgeCount `json:"indexAge"`
+}
+
+type prefixStats struct {
+	Prefix string `json:"prefix"`
+	Keys   int    `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type keySize struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+}
+
+type keyDepth struct {
+	Key   string `json:"key"`
+	Depth int    `json:"depth"`
+}
+
+// indexAgeCount counts the keys last modified fewer than Below indexes
+// before EtcdIndex. The last bucket has no upper bound.
+type indexAgeCount struct {
+	Below uint64 `json:"below,omitempty"`
+	Keys  int    `json:"keys"`
+}
+
+// Upper bounds of the ModifiedIndex age buckets.
+var indexAgeBounds = []uint64{10, 100, 1000, 10000, 100000, 1000000}
+
+func (o *Stats) check() error {
+	switch o.Format {
+	case "table", "json":
+	default:
+		return fmt.Errorf("unknown stats format %q, expected table or json", o.Format)
+	}
+	if o.Top < 0 {
+		return fmt.Errorf("invalid --top %d, expected 0 or more", o.Top)
+	}
+	return nil
+}
+
+func (o *Stats) Execute(args []string) error {
+	if err := o.check(); err != nil {
+		return err
+	}
+
+	var result *keyspaceStats
+	if o.Archive == "" {
+		response := getRootNode(opts.EtcdMachines)
+		result = newKeyspaceStats(response.Node, response.EtcdIndex, o.Top)
+	} else {
+		root, m, err := readArchive(o.Archive)
+		if err != nil {
+			return fmt.Errorf("could not read archive: %v", err)
+		}
+		// Older archives don't record the index they were taken at, so
+		// measure ages against the most recent modification instead.
+		etcdIndex := m.EtcdIndex
+		if etcdIndex == 0 {
+			etcdIndex = maxModifiedIndex(root)
+		}
+		result = newKeyspaceStats(root, etcdIndex, o.Top)
+		result.Redacted = m.Redacted
+	}
+
+	if o.Format == "json" {
+		out, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+		return nil
+	}
+	return result.writeTable(os.Stdout)
+}
+
+// newKeyspaceStats walks the tree below root, keeping the top largest values
+// and deepest keys.
+func newKeyspaceStats(root *etcd.Node, etcdIndex uint64, top int) *keyspaceStats {
+	s := &keyspaceStats{EtcdIndex: etcdIndex}
+	for _, bound := range indexAgeBounds {
+		s.IndexAge = append(s.IndexAge, indexAgeCount{Below: bound})
+	}
+	s.IndexAge = append(s.IndexAge, indexAgeCount{})
+
+	prefixes := map[string]*prefixStats{}
+	s.add(root, prefixes)
+
+	for _, prefix := range prefixes {
+		s.Prefixes = append(s.Prefixes, *prefix)
+	}
+	sort.Slice(s.Prefixes, func(i, j int) bool { return s.Prefixes[i].Prefix < s.Prefixes[j].Prefix })
+
+	sort.SliceStable(s.Largest, func(i, j int) bool { return s.Largest[i].Bytes > s.Largest[j].Bytes })
+	sort.SliceStable(s.Deepest, func(i, j int) bool { return s.Deepest[i].Depth > s.Deepest[j].Depth })
+	if len(s.Largest) > top {
+		s.Largest = s.Largest[:top]
+	}
+	if len(s.Deepest) > top {
+		s.Deepest = s.Deepest[:top]
+	}
+
+	return s
+}
+
+func (s *keyspaceStats) add(node *etcd.Node, prefixes map[string]*prefixStats) {
+	if node.Dir {
+		// The root has no key, and isn't counted.
+		if len(node.Key) > 0 {
+			s.Dirs++
+		}
+		for _, subNode := range node.Nodes {
+			s.add(subNode, prefixes)
+		}
+		return
+	}
+
+	size := int64(len(node.Value))
+	s.Keys++
+	s.ValueBytes += size
+	if node.Expiration != nil {
+		s.TTLKeys++
+	}
+
+	segments := strings.Split(strings.TrimPrefix(node.Key, "/"), "/")
+	prefix := "/" + segments[0]
+	if prefixes[prefix] == nil {
+		prefixes[prefix] = &prefixStats{Prefix: prefix}
+	}
+	prefixes[prefix].Keys++
+	prefixes[prefix].Bytes += size
+
+	s.Largest = append(s.Largest, keySize{Key: node.Key, Bytes: size})
+	s.Deepest = append(s.Deepest, keyDepth{Key: node.Key, Depth: len(segments)})
+
+	var age uint64
+	if s.EtcdIndex > node.ModifiedIndex {
+		age = s.EtcdIndex - node.ModifiedIndex
+	}
+	for i := range s.IndexAge {
+		if bucket := &s.IndexAge[i]; bucket.Below == 0 || age < bucket.Below {
+			bucket.Keys++
+			break
+		}
+	}
+}
+
+func (s *keyspaceStats) writeTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "KEYS\tDIRS\tVALUE BYTES\tWITH TTL\tETCD INDEX")
+	fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n", s.Keys, s.Dirs, s.ValueBytes, s.TTLKeys, s.EtcdIndex)
+	if s.Redacted {
+		fmt.Fprintln(w, "\nThe archive is redacted, value sizes are those of the redacted values.")
+	}
+
+	fmt.Fprintln(w, "\nPREFIX\tKEYS\tBYTES")
+	for _, prefix := range s.Prefixes {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", prefix.Prefix, prefix.Keys, prefix.Bytes)
+	}
+
+	fmt.Fprintln(w, "\nLARGEST\tBYTES")
+	for _, key := range s.Largest {
+		fmt.Fprintf(w, "%s\t%d\n", key.Key, key.Bytes)
+	}
+
+	fmt.Fprintln(w, "\nDEEPEST\tDEPTH")
+	for _, key := range s.Deepest {
+		fmt.Fprintf(w, "%s\t%d\n", key.Key, key.Depth)
+	}
+
+	fmt.Fprintln(w, "\nMODIFIED\tKEYS")
+	last := uint64(0)
+	for _, bucket := range s.IndexAge {
+		if bucket.Below == 0 {
+			fmt.Fprintf(w, "%d+ indexes ago\t%d\n", last, bucket.Keys)
+		} else {
+			fmt.Fprintf(w, "under %d indexes ago\t%d\n", bucket.Below, bucket.Keys)
+		}
+		last = bucket.Below
+	}
+
+	return w.Flush()
+}
+
+// maxModifiedIndex returns the highest ModifiedIndex below node.
+func maxModifiedIndex(node *etcd.Node) uint64 {
+	index := node.ModifiedIndex
+	for _, subNode := range node.Nodes {
+		if sub := maxModifiedIndex(subNode); sub > index {
+			index = sub
+		}
+	}
+	return index
+}
+
+func init() {
+	parser.AddCommand("stats",
+		"Describe the keyspace",
+		"Report the number and size of keys, per top-level prefix, the largest values, deepest keys, and how long ago keys were modified, for the cluster or an archive.",
+		&stats,
+	)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestStatsCheck(t *testing.T) {
+	for _, tt := range []struct {
+		o  Stats
+		ok bool
+	}{
+		{Stats{Format: "table", Top: 10}, true},
+		{Stats{Format: "json", Top: 0}, true},
+		{Stats{Format: "table", Top: -1}, false},
+		{Stats{Format: "yaml", Top: 10}, false},
+	} {
+		if err := tt.o.check(); (err == nil) != tt.ok {
+			t.Errorf("%+v: err = %v, want ok %t", tt.o, err, tt.ok)
+		}
+	}
+}
+
+func TestKeyspaceStatsTop(t *testing.T) {
+	root := &etcd.Node{Dir: true, Nodes: etcd.Nodes{
+		{Key: "/a", Value: "1"},
+		{Key: "/b", Value: "22"},
+		{Key: "/c", Dir: true, Nodes: etcd.Nodes{{Key: "/c/d", Value: "333"}}},
+	}}
+
+	s := newKeyspaceStats(root, 10, 2)
+	if len(s.Largest) != 2 || s.Largest[0].Key != "/c/d" || s.Largest[1].Key != "/b" {
+		t.Errorf("largest = %+v, want /c/d then /b", s.Largest)
+	}
+	if len(s.Deepest) != 2 || s.Deepest[0].Key != "/c/d" {
+		t.Errorf("deepest = %+v, want /c/d first", s.Deepest)
+	}
+
+	if s := newKeyspaceStats(root, 10, 0); len(s.Largest) != 0 || len(s.Deepest) != 0 || s.Keys != 3 {
+		t.Errorf("top 0 = %+v, want the counts only", s)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-etcd/etcd"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// backupStatus describes the last successful backup.
+type backupStatus struct {
+	// Cluster is the --cluster-name of the backup.
+	Cluster     string    `json:"cluster,omitempty"`
+	Time        time.Time `json:"time"`
+	Destination string    `json:"destination"`
+	Size        int64     `json:"size"`
+	Keys        int       `json:"keys"`
+	EtcdIndex   uint64    `json:"etcdIndex"`
+	ContentHash string    `json:"contentHash,omitempty"`
+	// Checked is the last time the cluster was found unchanged since this
+	// backup.
+	Checked *time.Time `json:"checked,omitempty"`
+}
+
+// statusStore is where backups of a cluster record their status: an etcd
+// key of the cluster, a local file, or both.
+type statusStore struct {
+	machines []string
+	key      string
+	file     string
+	log      *log.Entry
+}
+
+// defaultStatusStore is set by --status-key and --status-file.
+func defaultStatusStore() statusStore {
+	return statusStore{
+		machines: opts.EtcdMachines,
+		key:      opts.StatusKey,
+		file:     opts.StatusFile,
+		log:      log.NewEntry(log.StandardLogger()),
+	}
+}
+
+// record stores status in the key and the file, if set. Failing to do so
+// does not fail the backup itself.
+func (s statusStore) record(status backupStatus) {
+	if s.key == "" && s.file == "" {
+		return
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		s.log.WithField("error", err).Warn("could not encode backup status")
+		return
+	}
+
+	if s.key != "" {
+		client := etcd.NewClient(s.machines)
+		defer client.Close()
+
+		if _, err := client.Set(s.key, string(data), 0); err != nil {
+			s.log.WithFields(log.Fields{
+				"error": err,
+				"key":   s.key,
+			}).Warn("could not write backup status to etcd")
+		}
+	}
+
+	if s.file != "" {
+		err := writeFileAtomic(s.file, 0644, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			s.log.WithFields(log.Fields{
+				"error":    err,
+				"filepath": s.file,
+			}).Warn("could not write backup status file")
+		}
+	}
+}
+
+// read loads the status from the file if set, otherwise from the key.
+func (s statusStore) read() (*backupStatus, error) {
+	var data []byte
+	switch {
+	case s.file != "":
+		var err error
+		if data, err = ioutil.ReadFile(s.file); err != nil {
+			return nil, err
+		}
+	case s.key != "":
+		client := etcd.NewClient(s.machines)
+		defer client.Close()
+
+		response, err := client.Get(s.key, false, false)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(response.Node.Value)
+	default:
+		return nil, fmt.Errorf("neither --status-key nor --status-file is set")
+	}
+
+	status := new(backupStatus)
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, fmt.Errorf("could not decode backup status: %v", err)
+	}
+	return status, nil
+}
+
+type Status struct {
+	MaxAge         func(string) `long:"max-age" env:"STATUS_MAX_AGE" description:"Fail if the last backup is older than this"`
+	MaxAgeDuration time.Duration
+}
+
+var status Status
+
+func (o *Status) Execute(args []string) error {
+	last, err := defaultStatusStore().read()
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(last, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+
+	// A backup is as fresh as the last check that nothing changed since.
+	age := time.Since(last.Time)
+	if last.Checked != nil && last.Checked.After(last.Time) {
+		age = time.Since(*last.Checked)
+	}
+	if o.MaxAgeDuration > 0 && age > o.MaxAgeDuration {
+		return fmt.Errorf("last backup is %s old, more than %s", age.Truncate(time.Second), o.MaxAgeDuration)
+	}
+	return nil
+}
+
+func init() {
+	status.MaxAge = func(dur string) {
+		if pDur, err := time.ParseDuration(dur); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err,
+				"duration": dur,
+			}).Fatal("could not parse max age")
+		} else {
+			status.MaxAgeDuration = pDur
+		}
+	}
+
+	parser.AddCommand("status",
+		"Show last backup",
+		"Show the status recorded by the last successful backup, failing if it is older than --max-age.",
+		&status,
+	)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+)
+
+// lastUpload returns the status of the last upload of the cluster to S3,
+// from memory or else from the status store, nil if there is none.
+func (o *ToS3) lastUpload(store statusStore) *backupStatus {
+	if o.last == nil && (store.key != "" || store.file != "") {
+		last, err := store.read()
+		if err != nil {
+			store.log.WithField("error", err).Debug("no previous backup status")
+			return nil
+		}
+		o.last = last
+	}
+
+	// Backups to files don't make an upload unnecessary, nor do those of
+	// another cluster sharing the store. Statuses recorded before the
+	// cluster was are taken to be of this one.
+	if o.last == nil || !strings.HasPrefix(o.last.Destination, "s3://") {
+		return nil
+	}
+	if o.last.Cluster != "" && o.last.Cluster != o.ClusterName {
+		store.log.WithField("cluster", o.last.Cluster).Debug("last backup status is of another cluster")
+		return nil
+	}
+	return o.last
+}
+
+// unchanged reports whether the cluster is as it was at the last upload,
+// going by the etcd index, or else by the content hash.
+func (o *ToS3) unchanged(store statusStore, etcdIndex uint64, hash string) (*backupStatus, bool) {
+	last := o.lastUpload(store)
+	if last == nil {
+		return nil, false
+	}
+	return last, last.EtcdIndex == etcdIndex || (last.ContentHash != "" && last.ContentHash == hash)
+}